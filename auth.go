@@ -0,0 +1,80 @@
+package custommetrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requireBearerToken only lets requests through to the handler when they carry
+// "Authorization: Bearer <token>". The token is compared in constant time.
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) ||
+			subtle.ConstantTimeCompare([]byte(authorization[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireBasicAuth only lets requests through to the handler when they carry the
+// credentials with HTTP basic auth. Both the username and password are compared in
+// constant time, so neither can be guessed from response times.
+func requireBasicAuth(credentials BasicAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(credentials.Username))
+		passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(credentials.Password))
+		if !ok || usernameMatches&passwordMatches != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseCIDRs parses the networks allowed to scrape the metrics endpoint.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metricsAllowedCIDRs entry %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// requireAllowedAddress only lets requests through to the handler when their remote
+// address is in one of the networks, answering 403 otherwise.
+func requireAllowedAddress(networks []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
@@ -0,0 +1,257 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsAuthToken(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MetricsAuthToken = "s3cret"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(context.Background(), next, cfg, "auth-token-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	tests := []struct {
+		authorization string
+		expected      int
+	}{
+		{authorization: "Bearer s3cret", expected: http.StatusOK},
+		{authorization: "bearer s3cret", expected: http.StatusOK},
+		{authorization: "Bearer wrong", expected: http.StatusUnauthorized},
+		{authorization: "Bearer s3cret2", expected: http.StatusUnauthorized},
+		{authorization: "Basic s3cret", expected: http.StatusUnauthorized},
+		{authorization: "", expected: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		for _, path := range []string{"/metrics", "/metrics.json"} {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			plugin.MetricsHandler().ServeHTTP(recorder, req)
+
+			if recorder.Code != test.expected {
+				t.Errorf("%s with Authorization %q: expected status %d, got %d", path, test.authorization, test.expected, recorder.Code)
+			}
+		}
+	}
+}
+
+func TestSharedServerAuthTokenConflict(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = freePort(t)
+	cfg.MetricsAuthToken = "first"
+
+	handler, err := New(context.Background(), next, cfg, "auth-conflict-first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	cfg.MetricsAuthToken = "second"
+	if _, err := New(context.Background(), next, cfg, "auth-conflict-second"); err == nil {
+		t.Error("expected error for instances sharing a port with different tokens")
+	}
+}
+
+func TestMetricsBasicAuth(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MetricsAuth = BasicAuth{Username: "prometheus", Password: "s3cret"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(context.Background(), next, cfg, "basic-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expected int
+	}{
+		{name: "valid credentials", username: "prometheus", password: "s3cret", expected: http.StatusOK},
+		{name: "wrong password", username: "prometheus", password: "wrong", expected: http.StatusUnauthorized},
+		{name: "wrong username", username: "grafana", password: "s3cret", expected: http.StatusUnauthorized},
+		{name: "missing header", expected: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		for _, path := range []string{"/metrics", "/metrics.json"} {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+
+			recorder := httptest.NewRecorder()
+			plugin.MetricsHandler().ServeHTTP(recorder, req)
+
+			if recorder.Code != test.expected {
+				t.Errorf("%s on %s: expected status %d, got %d", test.name, path, test.expected, recorder.Code)
+			}
+			if test.expected == http.StatusUnauthorized && !strings.HasPrefix(recorder.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("%s on %s: expected a Basic challenge, got %q", test.name, path, recorder.Header().Get("WWW-Authenticate"))
+			}
+		}
+	}
+}
+
+func TestInvalidMetricsAuth(t *testing.T) {
+	tests := map[string]*Config{
+		"password without username": {MetricsAuth: BasicAuth{Password: "s3cret"}},
+		"combined with token":       {MetricsAuth: BasicAuth{Username: "prometheus", Password: "s3cret"}, MetricsAuthToken: "token"},
+	}
+
+	for name, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.MetricsAuth = test.MetricsAuth
+		cfg.MetricsAuthToken = test.MetricsAuthToken
+
+		_, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-basic-auth-test")
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+			continue
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("%s: expected the password not to appear in the error, got %q", name, err)
+		}
+	}
+}
+
+func TestSharedServerBasicAuthConflict(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = freePort(t)
+	cfg.MetricsAuth = BasicAuth{Username: "prometheus", Password: "first"}
+
+	handler, err := New(context.Background(), next, cfg, "basic-auth-conflict-first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	cfg.MetricsAuth.Password = "second"
+	_, err = New(context.Background(), next, cfg, "basic-auth-conflict-second")
+	if err == nil {
+		t.Fatal("expected error for instances sharing a port with different credentials")
+	}
+	if strings.Contains(err.Error(), "first") || strings.Contains(err.Error(), "second") {
+		t.Errorf("expected the credentials not to appear in the error, got %q", err)
+	}
+}
+
+func TestMetricsAllowedCIDRs(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MetricsAllowedCIDRs = []string{"10.0.0.0/8", "2001:db8::/32"}
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "allowed-cidrs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	tests := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{remoteAddr: "10.1.2.3:9090", expected: http.StatusOK},
+		{remoteAddr: "[::ffff:10.1.2.3]:9090", expected: http.StatusOK},
+		{remoteAddr: "[2001:db8::1]:9090", expected: http.StatusOK},
+		{remoteAddr: "192.168.1.1:9090", expected: http.StatusForbidden},
+		{remoteAddr: "[2001:db9::1]:9090", expected: http.StatusForbidden},
+		{remoteAddr: "invalid", expected: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		recorder := httptest.NewRecorder()
+		plugin.MetricsHandler().ServeHTTP(recorder, req)
+
+		if recorder.Code != test.expected {
+			t.Errorf("%s: expected status %d, got %d", test.remoteAddr, test.expected, recorder.Code)
+		}
+	}
+}
+
+func TestMetricsAllowedCIDRsEmptyAllowsAll(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "allow-all-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+	req.RemoteAddr = "198.51.100.1:9090"
+
+	recorder := httptest.NewRecorder()
+	handler.(*CustomMetrics).MetricsHandler().ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", recorder.Code)
+	}
+}
+
+func TestInvalidMetricsAllowedCIDRs(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0", "10.0.0.0/33", "2001:db8::/129", "not-a-network"} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.MetricsAllowedCIDRs = []string{cidr}
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-cidrs-test"); err == nil {
+			t.Errorf("expected error for %q", cidr)
+		}
+	}
+}
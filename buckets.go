@@ -0,0 +1,58 @@
+package custommetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultBucketLabelName is the label holding the value bucket of an observation.
+const DefaultBucketLabelName = "bucket"
+
+// unknownBucketValue is the bucket label value of observations without a numeric value.
+const unknownBucketValue = "unknown"
+
+// valueBuckets classifies numeric values into the ranges between sorted bounds, so a
+// label derived from them has at most one value more than there are bounds.
+type valueBuckets struct {
+	bounds []float64
+	names  []string // Label value of each range, one more than bounds
+}
+
+// parseValueBuckets sorts the bounds of ValueBuckets and names the ranges they delimit:
+// bounds of 1024 and 65536 name "lt_1024", "1024_65536" and "gte_65536".
+func parseValueBuckets(bounds []float64) (*valueBuckets, error) {
+	sorted := make([]float64, 0, len(bounds))
+	for _, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return nil, fmt.Errorf("valueBuckets bound must be finite, got %v", bound)
+		}
+		sorted = append(sorted, bound)
+	}
+	sort.Float64s(sorted)
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return nil, fmt.Errorf("duplicate valueBuckets bound %v", sorted[i])
+		}
+	}
+
+	names := make([]string, 0, len(sorted)+1)
+	names = append(names, "lt_"+formatValue(sorted[0]))
+	for i := 1; i < len(sorted); i++ {
+		names = append(names, formatValue(sorted[i-1])+"_"+formatValue(sorted[i]))
+	}
+	names = append(names, "gte_"+formatValue(sorted[len(sorted)-1]))
+
+	return &valueBuckets{bounds: sorted, names: names}, nil
+}
+
+// classify returns the name of the range holding a value. Ranges include their lower bound
+// and exclude their upper bound. Missing values fall in the unknown bucket.
+func (b *valueBuckets) classify(value float64, ok bool) string {
+	if !ok || math.IsNaN(value) {
+		return unknownBucketValue
+	}
+	i := sort.Search(len(b.bounds), func(i int) bool { return value < b.bounds[i] })
+	return b.names[i]
+}
@@ -0,0 +1,102 @@
+package custommetrics
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValueBucketsClassify(t *testing.T) {
+	buckets, err := parseValueBuckets([]float64{65536, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value    float64
+		ok       bool
+		expected string
+	}{
+		{value: 0, ok: true, expected: "lt_1024"},
+		{value: 1023.999, ok: true, expected: "lt_1024"},
+		{value: 1024, ok: true, expected: "1024_65536"},
+		{value: 65535, ok: true, expected: "1024_65536"},
+		{value: 65536, ok: true, expected: "gte_65536"},
+		{value: math.Inf(1), ok: true, expected: "gte_65536"},
+		{value: math.Inf(-1), ok: true, expected: "lt_1024"},
+		{value: math.NaN(), ok: true, expected: "unknown"},
+		{ok: false, expected: "unknown"},
+	}
+
+	for _, test := range tests {
+		if bucket := buckets.classify(test.value, test.ok); bucket != test.expected {
+			t.Errorf("classify(%v, %v) = %q, expected %q", test.value, test.ok, bucket, test.expected)
+		}
+	}
+}
+
+func TestInvalidValueBuckets(t *testing.T) {
+	for _, bounds := range [][]float64{{1, 1}, {math.NaN()}, {math.Inf(1)}} {
+		if _, err := parseValueBuckets(bounds); err == nil {
+			t.Errorf("expected bounds %v to be rejected", bounds)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.DisableServer = true
+	cfg.BucketLabelName = "size_class"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "buckets-test"); err == nil {
+		t.Error("expected bucketLabelName without valueBuckets to be rejected")
+	}
+
+	cfg.ValueBuckets = []float64{1024}
+	cfg.BucketLabelName = "x_tenant"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "buckets-test"); err == nil {
+		t.Error("expected bucketLabelName colliding with a header label to be rejected")
+	}
+}
+
+func TestValueBucketLabel(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.DisableSelfMetrics = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "requests_by_size", Type: MetricTypeCounter, Headers: []string{"X-Tenant"}, ValueHeader: "Content-Length"},
+	}
+	cfg.ValueBuckets = []float64{1024, 65536}
+	cfg.BucketLabelName = "size_class"
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "buckets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range []string{"1023", "1024", "65536", "large", ""} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "a")
+		if length != "" {
+			req.Header.Set("Content-Length", length)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	output := handler.(*CustomMetrics).renderPrometheusFormat()
+	for _, expected := range []string{
+		`requests_by_size_total{size_class="lt_1024",x_tenant="a"} 1`,
+		`requests_by_size_total{size_class="1024_65536",x_tenant="a"} 1`,
+		`requests_by_size_total{size_class="gte_65536",x_tenant="a"} 1`,
+		`requests_by_size_total{size_class="unknown",x_tenant="a"} 2`,
+	} {
+		if !strings.Contains(output, expected+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
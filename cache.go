@@ -0,0 +1,41 @@
+package custommetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// renderCache holds a rendered exposition for a limited time, so that scrapes arriving
+// within the TTL do not each walk every series. The first scrape to find it stale rebuilds it
+// while concurrent scrapes wait for the result, so it is rebuilt at most once per TTL.
+type renderCache struct {
+	ttl    time.Duration
+	render func() string
+	now    func() time.Time // Clock used to age the exposition, replaceable in tests
+
+	mu         sync.Mutex
+	rendered   string
+	renderedAt time.Time
+}
+
+// newRenderCache creates a cache of the output of render.
+func newRenderCache(ttl time.Duration, render func() string) *renderCache {
+	return &renderCache{
+		ttl:    ttl,
+		render: render,
+		now:    time.Now,
+	}
+}
+
+// get returns the cached exposition, rendering it again if it is older than the TTL.
+func (r *renderCache) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.renderedAt.IsZero() || now.Sub(r.renderedAt) >= r.ttl {
+		r.rendered = r.render()
+		r.renderedAt = now
+	}
+	return r.rendered
+}
@@ -0,0 +1,126 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderCacheRebuildsOncePerTTL(t *testing.T) {
+	var renders int
+	cache := newRenderCache(10*time.Second, func() string {
+		renders++
+		return "render " + strconv.Itoa(renders)
+	})
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	if output := cache.get(); output != "render 1" {
+		t.Errorf("expected first render, got %q", output)
+	}
+
+	// Within the TTL the cached exposition is served
+	now = now.Add(9 * time.Second)
+	if output := cache.get(); output != "render 1" {
+		t.Errorf("expected cached render, got %q", output)
+	}
+
+	// Once stale it is rebuilt and served for another TTL
+	now = now.Add(time.Second)
+	if output := cache.get(); output != "render 2" {
+		t.Errorf("expected second render, got %q", output)
+	}
+	if output := cache.get(); output != "render 2" {
+		t.Errorf("expected cached second render, got %q", output)
+	}
+	if renders != 2 {
+		t.Errorf("expected 2 renders, got %d", renders)
+	}
+}
+
+func TestRenderCacheConcurrentScrapes(t *testing.T) {
+	var mu sync.Mutex
+	var renders int
+	cache := newRenderCache(time.Hour, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		renders++
+		return "metrics"
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if output := cache.get(); output != "metrics" {
+				t.Errorf("expected cached render, got %q", output)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if renders != 1 {
+		t.Errorf("expected stale scrapes to share 1 render, got %d", renders)
+	}
+}
+
+func TestServerServesCachedExposition(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "cached_requests"
+	cfg.MetricsPort = 0
+	cfg.RenderCacheTTL = "1h"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "render-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	serve := func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve()
+	first := scrape(t, plugin.ActualPort())
+	if !strings.Contains(first, `cached_requests_total{x_user_id="user123"} 1`) {
+		t.Errorf("expected the first request in the exposition, got:\n%s", first)
+	}
+
+	// Requests after the exposition was cached are not visible until it expires
+	serve()
+	if second := scrape(t, plugin.ActualPort()); second != first {
+		t.Errorf("expected the cached exposition %q, got %q", first, second)
+	}
+}
+
+func TestInvalidRenderCacheTTL(t *testing.T) {
+	for _, ttl := range []string{"soon", "0s", "-1s"} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.RenderCacheTTL = ttl
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-render-cache"); err == nil {
+			t.Errorf("expected an error for renderCacheTTL %q", ttl)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package custommetrics
+
+import (
+	"net"
+	"strings"
+)
+
+// invalidClientIPValue is the client IP label value for addresses that cannot be parsed.
+const invalidClientIPValue = "invalid"
+
+// clientIP returns the client address of a request: the first X-Forwarded-For hop when
+// present, otherwise the host part of the remote address. Anonymized IPv4 addresses have
+// their last octet zeroed and IPv6 addresses their last 80 bits.
+func clientIP(forwardedFor, remoteAddr string, anonymize bool) string {
+	if anonymize {
+		return maskedClientIP(forwardedFor, remoteAddr, 24, 48)
+	}
+	return maskedClientIP(forwardedFor, remoteAddr, 0, 0)
+}
+
+// maskedClientIP returns the client address like clientIP, masked to its first ipv4Bits
+// bits for IPv4 addresses and ipv6Bits bits for IPv6 addresses. A size of 0 keeps the
+// whole address. IPv4-mapped IPv6 addresses are treated as IPv4.
+func maskedClientIP(forwardedFor, remoteAddr string, ipv4Bits, ipv6Bits int) string {
+	raw := remoteAddr
+	if forwardedFor != "" {
+		raw = forwardedFor
+		if comma := strings.IndexByte(raw, ','); comma >= 0 {
+			raw = raw[:comma]
+		}
+		raw = strings.TrimSpace(raw)
+	} else if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		raw = host
+	}
+
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return invalidClientIPValue
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		if ipv4Bits == 0 {
+			return ipv4.String()
+		}
+		return ipv4.Mask(net.CIDRMask(ipv4Bits, 32)).String()
+	}
+	if ipv6Bits == 0 {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6Bits, 128)).String()
+}
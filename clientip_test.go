@@ -0,0 +1,185 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		forwardedFor string
+		remoteAddr   string
+		anonymize    bool
+		expected     string
+	}{
+		{remoteAddr: "192.0.2.17:54321", expected: "192.0.2.17"},
+		{remoteAddr: "192.0.2.17:54321", anonymize: true, expected: "192.0.2.0"},
+		{remoteAddr: "192.0.2.17", expected: "192.0.2.17"},
+		{forwardedFor: "203.0.113.9, 10.0.0.1", remoteAddr: "10.0.0.1:80", expected: "203.0.113.9"},
+		{forwardedFor: " 203.0.113.9 ", remoteAddr: "10.0.0.1:80", anonymize: true, expected: "203.0.113.0"},
+		{remoteAddr: "[2001:db8:abcd:1234:5678:9abc:def0:1]:443", expected: "2001:db8:abcd:1234:5678:9abc:def0:1"},
+		{remoteAddr: "[2001:db8:abcd:1234:5678:9abc:def0:1]:443", anonymize: true, expected: "2001:db8:abcd::"},
+		{forwardedFor: "2001:db8:abcd:1234::1", remoteAddr: "10.0.0.1:80", anonymize: true, expected: "2001:db8:abcd::"},
+		{remoteAddr: "[::ffff:192.0.2.17]:80", anonymize: true, expected: "192.0.2.0"},
+		{forwardedFor: "unknown", remoteAddr: "10.0.0.1:80", expected: invalidClientIPValue},
+		{remoteAddr: "not-an-ip:80", expected: invalidClientIPValue},
+		{remoteAddr: "", expected: invalidClientIPValue},
+	}
+
+	for _, test := range tests {
+		if ip := clientIP(test.forwardedFor, test.remoteAddr, test.anonymize); ip != test.expected {
+			t.Errorf("clientIP(%q, %q, %v): expected %q, got %q", test.forwardedFor, test.remoteAddr, test.anonymize, test.expected, ip)
+		}
+	}
+}
+
+func TestClientIPLabel(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "client_ip_test"
+	cfg.DisableServer = true
+	cfg.ClientIPLabel = true
+	cfg.AnonymizeIP = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "client-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remoteAddr := range []string{"192.0.2.17:1000", "192.0.2.200:2000", "[2001:db8::1]:3000"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`client_ip_test_total{client_ip="192.0.2.0",x_tenant="acme"} 2`,
+		`client_ip_test_total{client_ip="2001:db8::",x_tenant="acme"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestMaskedClientIP(t *testing.T) {
+	tests := []struct {
+		forwardedFor string
+		remoteAddr   string
+		ipv4Bits     int
+		ipv6Bits     int
+		expected     string
+	}{
+		{remoteAddr: "192.0.2.17:54321", expected: "192.0.2.17"},
+		{remoteAddr: "192.0.2.17:54321", ipv4Bits: 24, expected: "192.0.2.0"},
+		{remoteAddr: "192.0.2.17:54321", ipv4Bits: 16, ipv6Bits: 128, expected: "192.0.0.0"},
+		{remoteAddr: "[::ffff:192.0.2.17]:80", ipv4Bits: 24, ipv6Bits: 16, expected: "192.0.2.0"},
+		{remoteAddr: "[2001:db8:abcd:1234::1]:443", ipv4Bits: 24, expected: "2001:db8:abcd:1234::1"},
+		{remoteAddr: "[2001:db8:abcd:1234::1]:443", ipv6Bits: 64, expected: "2001:db8:abcd:1234::"},
+		{remoteAddr: "[2001:db8:abcd:1234::1]:443", ipv4Bits: 32, ipv6Bits: 32, expected: "2001:db8::"},
+		{forwardedFor: "203.0.113.9, 10.0.0.1", remoteAddr: "10.0.0.1:80", ipv4Bits: 24, expected: "203.0.113.0"},
+	}
+
+	for _, test := range tests {
+		if ip := maskedClientIP(test.forwardedFor, test.remoteAddr, test.ipv4Bits, test.ipv6Bits); ip != test.expected {
+			t.Errorf("maskedClientIP(%q, %q, %d, %d): expected %q, got %q", test.forwardedFor, test.remoteAddr, test.ipv4Bits, test.ipv6Bits, test.expected, ip)
+		}
+	}
+}
+
+func TestRemoteIPLabel(t *testing.T) {
+	newHandler := func(t *testing.T, configure func(*Config)) http.Handler {
+		t.Helper()
+
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tenant"}
+		cfg.MetricName = "remote_ip_test"
+		cfg.DisableServer = true
+		cfg.IncludeRemoteIP = true
+		configure(cfg)
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "remote-ip-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	serve := func(handler http.Handler, remoteAddr, forwardedFor string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Tenant", "acme")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return handler.(*CustomMetrics).renderPrometheusFormat()
+	}
+
+	t.Run("direct IPv4", func(t *testing.T) {
+		handler := newHandler(t, func(cfg *Config) {})
+
+		// Without TrustXFF a forged header does not change the label
+		output := serve(handler, "192.0.2.17:1000", "198.51.100.1")
+		if line := `remote_ip_test_total{remote_ip="192.0.2.17",x_tenant="acme"} 1`; !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	})
+
+	t.Run("forwarded chain", func(t *testing.T) {
+		handler := newHandler(t, func(cfg *Config) {
+			cfg.TrustXFF = true
+			cfg.RemoteIPMask = 24
+		})
+
+		output := serve(handler, "10.0.0.1:1000", "203.0.113.9, 198.51.100.7, 10.0.0.1")
+		if line := `remote_ip_test_total{remote_ip="203.0.113.0",x_tenant="acme"} 1`; !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	})
+
+	t.Run("masked IPv6", func(t *testing.T) {
+		handler := newHandler(t, func(cfg *Config) {
+			cfg.RemoteIPMask = 24
+			cfg.RemoteIPv6Mask = 64
+		})
+
+		serve(handler, "[2001:db8:abcd:1234::1]:1000", "")
+		output := serve(handler, "[2001:db8:abcd:1234:ffff::2]:2000", "")
+		if line := `remote_ip_test_total{remote_ip="2001:db8:abcd:1234::",x_tenant="acme"} 2`; !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	})
+}
+
+func TestInvalidRemoteIPMask(t *testing.T) {
+	tests := map[string]func(*Config){
+		"negative IPv4 mask": func(cfg *Config) { cfg.RemoteIPMask = -1 },
+		"IPv4 mask too long": func(cfg *Config) { cfg.RemoteIPMask = 33 },
+		"IPv6 mask too long": func(cfg *Config) { cfg.RemoteIPv6Mask = 129 },
+	}
+
+	for name, configure := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tenant"}
+		cfg.DisableServer = true
+		cfg.IncludeRemoteIP = true
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-remote-ip-mask"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
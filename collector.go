@@ -0,0 +1,75 @@
+package custommetrics
+
+import "sync"
+
+// DefaultQueueSize is the default number of observations buffered for asynchronous collection.
+const DefaultQueueSize = 4096
+
+// asyncCollector applies the observations of served requests to the store from a single
+// goroutine, so requests only pay for resolving and queueing them.
+type asyncCollector struct {
+	mu      sync.RWMutex // Held for reading while queueing, so closing waits for queueing to end
+	closed  bool
+	queue   chan observation
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newAsyncCollector creates a collector queueing up to size observations.
+func newAsyncCollector(size int) *asyncCollector {
+	return &asyncCollector{
+		queue:   make(chan observation, size),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// enqueue hands an observation to the collector goroutine. Observations are dropped and counted
+// when the queue is full rather than holding up the request. Once the collector is stopped they
+// are applied directly, as nothing would drain the queue anymore.
+func (c *CustomMetrics) enqueue(obs observation) {
+	c.collector.mu.RLock()
+	if c.collector.closed {
+		c.collector.mu.RUnlock()
+		c.applyObservation(obs)
+		return
+	}
+	select {
+	case c.collector.queue <- obs:
+	default:
+		c.incrementInternal(droppedObservationsMetricName)
+	}
+	c.collector.mu.RUnlock()
+}
+
+// stopCollector stops the collector goroutine and waits for it to drain the queue.
+func (c *CustomMetrics) stopCollector() {
+	c.collector.mu.Lock()
+	c.collector.closed = true
+	c.collector.mu.Unlock()
+
+	close(c.collector.stop)
+	<-c.collector.stopped
+}
+
+// runCollector applies queued observations until the plugin is stopped, then drains the queue
+// so observations of requests already served are not lost.
+func (c *CustomMetrics) runCollector() {
+	defer close(c.collector.stopped)
+
+	for {
+		select {
+		case obs := <-c.collector.queue:
+			c.applyObservation(obs)
+		case <-c.collector.stop:
+			for {
+				select {
+				case obs := <-c.collector.queue:
+					c.applyObservation(obs)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
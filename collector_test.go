@@ -0,0 +1,121 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAsyncCollectionDrainsOnStop(t *testing.T) {
+	const observations = 500
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant", "X-Upstream"}
+	cfg.MetricName = "async_test"
+	cfg.DisableServer = true
+	cfg.StatusCodeLabel = true
+	cfg.AsyncCollection = true
+	cfg.QueueSize = observations
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Upstream", "b")
+		rw.WriteHeader(http.StatusAccepted)
+	})
+
+	handler, err := New(ctx, next, cfg, "async-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	serve := func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "a")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		// Observations are resolved before ServeHTTP returns, so the request may be reused
+		req.Header.Set("X-Tenant", "reused")
+	}
+	for i := 0; i < observations; i++ {
+		serve()
+	}
+
+	if err := plugin.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"status": "202", "x_tenant": "a", "x_upstream": "b"}
+	metric, ok := plugin.GetMetric("async_test", labels)
+	if !ok || metric.Value != observations {
+		t.Errorf("expected %d observations after Stop, got %v", observations, metric)
+	}
+
+	// Requests served after Stop are applied directly rather than left in the queue
+	serve()
+	if metric, ok := plugin.GetMetric("async_test", labels); !ok || metric.Value != observations+1 {
+		t.Errorf("expected %d observations after serving past Stop, got %v", observations+1, metric)
+	}
+	if dropped := plugin.store.internalMetric(droppedObservationsMetricName); dropped != nil {
+		t.Errorf("expected no dropped observations, got %v", dropped.Value)
+	}
+}
+
+func TestAsyncCollectionDropsWhenFull(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "async_full_test"
+	cfg.DisableServer = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "async-full-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	// A collector that is not running yet holds a single observation
+	plugin.collector = newAsyncCollector(1)
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "a")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	go plugin.runCollector()
+	if err := plugin.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`async_full_test_total{x_tenant="a"} 1`,
+		`custommetrics_dropped_observations_total{plugin="async-full-test"} 2`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestInvalidQueueSize(t *testing.T) {
+	for _, async := range []bool{true, false} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tenant"}
+		cfg.DisableServer = true
+		cfg.AsyncCollection = async
+		cfg.QueueSize = -1
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "queue-size-test"); err == nil {
+			t.Errorf("expected queueSize -1 to be rejected with asyncCollection %v", async)
+		}
+	}
+}
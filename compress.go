@@ -0,0 +1,72 @@
+package custommetrics
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipWriters reuses gzip writers across scrapes.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// gzipResponseWriter compresses everything written to the response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+// Write compresses data into the response.
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.writer.Write(data)
+}
+
+// compressResponse gzip-compresses responses for clients that accept it.
+func compressResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		writer, _ := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(w)
+		defer func() {
+			_ = writer.Close()
+			gzipWriters.Put(writer)
+		}()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, writer: writer}, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			// An explicit q=0 refuses the encoding
+			params = strings.TrimSpace(params)
+			if strings.HasPrefix(params, "q=") {
+				if q, err := strconv.ParseFloat(params[len("q="):], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
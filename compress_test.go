@@ -0,0 +1,148 @@
+package custommetrics
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       bool
+	}{
+		{acceptEncoding: "", expected: false},
+		{acceptEncoding: "gzip", expected: true},
+		{acceptEncoding: "deflate, GZIP;q=0.8", expected: true},
+		{acceptEncoding: "br, deflate", expected: false},
+		{acceptEncoding: "gzip;q=0", expected: false},
+		{acceptEncoding: "gzip; q=0.000", expected: false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		if accepted := acceptsGzip(req); accepted != test.expected {
+			t.Errorf("Accept-Encoding %q: expected %v, got %v", test.acceptEncoding, test.expected, accepted)
+		}
+	}
+}
+
+func TestGzipMetricsResponse(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "gzip_test"
+	cfg.MetricsPort = 0
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "gzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Disable the transport's transparent decompression to observe the raw response
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	fetch := func(acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = reader
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, data
+	}
+
+	plainResp, plain := fetch("")
+	if encoding := plainResp.Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected a plaintext response, got Content-Encoding %q", encoding)
+	}
+
+	gzipResp, decompressed := fetch("gzip")
+	if encoding := gzipResp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("expected a gzip response, got Content-Encoding %q", encoding)
+	}
+	if contentType := gzipResp.Header.Get("Content-Type"); contentType != plainResp.Header.Get("Content-Type") {
+		t.Errorf("expected compression to keep the content type %q, got %q", plainResp.Header.Get("Content-Type"), contentType)
+	}
+
+	if len(plain) == 0 || string(decompressed) != string(plain) {
+		t.Errorf("expected the decompressed body to match the plaintext body:\n%s\nvs\n%s", decompressed, plain)
+	}
+}
+
+func TestGzipStreamsResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+
+	// Large expositions reach the client while they are still being written
+	var streamed bool
+	var plain strings.Builder
+	handler := compressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100000; i++ {
+			line := `streamed_requests_total{x_user_id="user` + strconv.Itoa(i) + `"} 1` + "\n"
+			plain.WriteString(line)
+			if _, err := io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		streamed = recorder.Body.Len() > 0
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(recorder, req)
+
+	if !streamed {
+		t.Error("expected compressed output to be written before the handler returned")
+	}
+
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != plain.String() {
+		t.Error("expected the decompressed body to match the written body")
+	}
+}
@@ -2,14 +2,24 @@
 package custommetrics
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,14 +28,371 @@ const (
 	MetricTypeCounter   = "counter"   // MetricTypeCounter represents a counter metric.
 	MetricTypeHistogram = "histogram" // MetricTypeHistogram represents a histogram metric.
 	MetricTypeGauge     = "gauge"     // MetricTypeGauge represents a gauge metric.
+	MetricTypeSummary   = "summary"   // MetricTypeSummary represents a summary metric.
+)
+
+// Exposition format constants.
+const (
+	ExpositionFormatPrometheus  = "prometheus"  // ExpositionFormatPrometheus is the classic Prometheus text format.
+	ExpositionFormatOpenMetrics = "openmetrics" // ExpositionFormatOpenMetrics is the OpenMetrics text format.
+)
+
+// Gauge aggregation constants.
+const (
+	GaugeAggregationLast = "last" // GaugeAggregationLast keeps the most recent observation.
+	GaugeAggregationMax  = "max"  // GaugeAggregationMax keeps the largest observation.
+	GaugeAggregationMin  = "min"  // GaugeAggregationMin keeps the smallest observation.
+	GaugeAggregationAvg  = "avg"  // GaugeAggregationAvg averages the observations.
+)
+
+// Multi-value strategy constants, deciding the label value of headers sent several times.
+const (
+	MultiValueFirst = "first" // MultiValueFirst keeps the first value.
+	MultiValueJoin  = "join"  // MultiValueJoin joins every value with the separator.
+	MultiValueCount = "count" // MultiValueCount uses the number of values.
+)
+
+// Header source constants, deciding where a header is read from.
+const (
+	HeaderSourceAny      = "any"      // HeaderSourceAny reads the request header, then the response header.
+	HeaderSourceRequest  = "request"  // HeaderSourceRequest only reads the request header.
+	HeaderSourceResponse = "response" // HeaderSourceResponse only reads the response header, which clients cannot spoof.
+)
+
+// DefaultAllowedValuesOther replaces label values missing from the allowed values of their header.
+const DefaultAllowedValuesOther = "other"
+
+// DefaultMultiValueSeparator joins the values of repeated headers with the join strategy.
+const DefaultMultiValueSeparator = ","
+
+// Gauge mode constants.
+const (
+	GaugeModeSet = "set" // GaugeModeSet sets the gauge to each observation, combined by the gauge aggregation.
+	GaugeModeAdd = "add" // GaugeModeAdd adds each observation, such as "+5" or "-3", to the gauge.
+	GaugeModeMax = "max" // GaugeModeMax keeps the largest observation ever made.
+	GaugeModeMin = "min" // GaugeModeMin keeps the smallest observation ever made.
+)
+
+// Content types of the exposition formats.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	jsonContentType        = "application/json"
+
+	openMetricsMediaType = "application/openmetrics-text" // Media type scrapers ask for to get OpenMetrics
+)
+
+// DefaultMetricsPath is the default path of the metrics endpoint.
+const DefaultMetricsPath = "/metrics"
+
+// DefaultMetricHelp is the HELP text of metrics configured without one.
+const DefaultMetricHelp = "Custom metric based on HTTP headers"
+
+// DefaultMaxSeries is the default limit on the number of series per plugin instance.
+const DefaultMaxSeries = 10000
+
+// overflowLabelValue replaces every label value of series folded beyond the series limit.
+const overflowLabelValue = "__overflow__"
+
+// reservedMetricPrefix starts the names of the metrics the plugin reports about itself.
+const reservedMetricPrefix = "custommetrics_"
+
+// Names of the metrics the plugin reports about itself.
+const (
+	overflowObservationsMetricName  = "custommetrics_overflow_observations"
+	droppedSamplesMetricName        = "custommetrics_dropped_samples"
+	scrapesMetricName               = "custommetrics_scrapes"
+	unlabeledObservationsMetricName = "custommetrics_unlabeled_observations"
+	droppedObservationsMetricName   = "custommetrics_dropped_observations"
+	seriesMetricName                = "custommetrics_series"
 )
 
 // Config the plugin configuration.
 type Config struct {
 	MetricHeaders []string `json:"metricHeaders,omitempty"`
 	MetricName    string   `json:"metricName,omitempty"`
-	MetricType    string   `json:"metricType,omitempty"`  // "counter", "histogram", "gauge"
+	MetricHelp    string   `json:"metricHelp,omitempty"`  // HELP text of the metric, defaulting to DefaultMetricHelp
+	MetricType    string   `json:"metricType,omitempty"`  // "counter", "histogram", "gauge", "summary"
 	MetricsPort   int      `json:"metricsPort,omitempty"` // Port for metrics endpoint
+	MetricsPath   string   `json:"metricsPath,omitempty"` // Path for metrics endpoint
+
+	// DisableServer collects metrics without starting a metrics server.
+	// They are then only exposed through the handler returned by MetricsHandler.
+	DisableServer bool `json:"disableServer,omitempty"`
+
+	MetricQueryParams []string `json:"metricQueryParams,omitempty"` // Query parameters used as labels alongside MetricHeaders
+	MetricCookies     []string `json:"metricCookies,omitempty"`     // Cookies used as labels alongside MetricHeaders; hash long or sensitive ones with LabelTransforms
+
+	// PortFallback serves the metrics on a random port when another process already listens on
+	// MetricsPort, instead of failing. The chosen port is logged and returned by ActualPort.
+	PortFallback bool `json:"portFallback,omitempty"`
+
+	// MetricsAddress is the IP address or host name the metrics server binds to, e.g. "127.0.0.1",
+	// "::1" or "localhost", IPv6 addresses optionally in brackets. Empty binds all interfaces.
+	// The port is set by MetricsPort.
+	MetricsAddress string `json:"metricsAddress,omitempty"`
+
+	ExpositionFormat string `json:"expositionFormat,omitempty"` // "prometheus" or "openmetrics"
+
+	// MetricsAuthToken requires scrapes to send "Authorization: Bearer <token>". Empty leaves the endpoint open.
+	MetricsAuthToken string `json:"metricsAuthToken,omitempty"`
+
+	// MetricsAuth requires scrapes to authenticate with HTTP basic auth. An empty username leaves the endpoint open.
+	MetricsAuth BasicAuth `json:"metricsAuth,omitempty"`
+
+	// MetricsAllowedCIDRs restricts scrapes to clients in these networks, e.g. "10.0.0.0/8" or "fd00::/8".
+	// Other clients are answered with 403. Empty allows every client.
+	MetricsAllowedCIDRs []string `json:"metricsAllowedCIDRs,omitempty"`
+
+	// MetricsTLS serves the metrics endpoint over HTTPS with the certificate and key in these PEM files.
+	MetricsTLS TLSCertificate `json:"metricsTLS,omitempty"`
+
+	// EnableReset serves a /reset endpoint deleting every collected series on POST, e.g. between
+	// load test runs, or only zeroing their values with ?mode=zero. It is behind the same
+	// authentication as the metrics. Not meant for production.
+	EnableReset bool `json:"enableReset,omitempty"`
+
+	// StatsDAddress pushes every observation to this StatsD server over UDP, e.g. "127.0.0.1:8125",
+	// with labels as DogStatsD tags. Combine with DisableServer to only push.
+	StatsDAddress string `json:"statsDAddress,omitempty"`
+
+	// OTLPEndpoint periodically pushes all series to this OTLP/HTTP receiver using the protobuf
+	// encoding, e.g. "http://otel-collector:4318/v1/metrics". OTLPInterval sets how often, e.g. "10s".
+	OTLPEndpoint string `json:"otlpEndpoint,omitempty"`
+	OTLPInterval string `json:"otlpInterval,omitempty"`
+
+	// PushgatewayURL periodically pushes the exposition to this Prometheus Pushgateway, e.g.
+	// "http://pushgateway:9091", grouped by PushgatewayJob and the plugin name as instance.
+	// PushInterval sets how often, e.g. "10s".
+	PushgatewayURL string `json:"pushgatewayURL,omitempty"`
+	PushgatewayJob string `json:"pushgatewayJob,omitempty"`
+	PushInterval   string `json:"pushInterval,omitempty"`
+
+	// AppendTotalSuffix renders counters as <name>_total in the Prometheus format.
+	// OpenMetrics always suffixes counter samples.
+	AppendTotalSuffix bool `json:"appendTotalSuffix,omitempty"`
+
+	StatusCodeLabel  bool `json:"statusCodeLabel,omitempty"`  // Add the response status code as a "status" label
+	StatusClassLabel bool `json:"statusClassLabel,omitempty"` // Add the response status class, e.g. "4xx", as a "status_class" label
+
+	// DisableLabelSanitization uses header, query parameter and cookie names as label names as is.
+	// Names such as "X-User-ID" are then not valid Prometheus label names.
+	DisableLabelSanitization bool `json:"disableLabelSanitization,omitempty"`
+
+	// OmitEmptyLabels leaves out the label of a header, query parameter or cookie the request
+	// does not carry, instead of adding it with an empty value.
+	OmitEmptyLabels bool `json:"omitEmptyLabels,omitempty"`
+
+	// DisableSelfMetrics leaves out the metrics the plugin reports about itself, which are all named
+	// with the custommetrics_ prefix: scrapes, current series, and dropped, overflow and unlabeled observations.
+	DisableSelfMetrics bool `json:"disableSelfMetrics,omitempty"`
+
+	// ReadyWithoutTraffic reports the instance ready on /readyz as soon as it starts, instead of
+	// once it has handled a request.
+	ReadyWithoutTraffic bool `json:"readyWithoutTraffic,omitempty"`
+
+	// AllowNoLabels accepts counters without any header, query parameter or cookie, such as one
+	// counting every request through a router, and other metrics without them but with a ValueHeader.
+	AllowNoLabels bool `json:"allowNoLabels,omitempty"`
+
+	// RequireAnyLabel skips collecting a metric for requests where all of its headers, query parameters
+	// and cookies are missing, rather than recording a series whose labels are all empty. Skipped
+	// observations are counted by custommetrics_unlabeled_observations.
+	RequireAnyLabel bool `json:"requireAnyLabel,omitempty"`
+
+	// ConstLabels are added to every series, e.g. {"cluster": "eu-west"}. Their names are sanitized
+	// like header names. A const label takes precedence over any label derived from the request with
+	// the same name, such as a header label or the "method" label of IncludeMethod, which is then left out.
+	ConstLabels map[string]string `json:"constLabels,omitempty"`
+
+	// MaxSeries caps the number of label combinations kept per plugin instance.
+	// Once reached, new combinations are folded into an overflow series. Zero disables the limit.
+	MaxSeries int `json:"maxSeries,omitempty"`
+
+	// SampleRate collects metrics for this random fraction of requests, within (0, 1], to cut the
+	// overhead on hot routes. Only sampled requests are observed by gauges, histograms and
+	// summaries; ScaleSampledCounters increments counters by 1/SampleRate times their value so
+	// totals stay unbiased. In-flight gauges still track every request.
+	SampleRate           float64 `json:"sampleRate,omitempty"`
+	ScaleSampledCounters bool    `json:"scaleSampledCounters,omitempty"`
+
+	// AsyncCollection applies observations to the store from a background goroutine, so requests
+	// only resolve their labels and values and queue them. Observations are dropped and counted when
+	// QueueSize observations are already waiting. Stopping the plugin applies those left in the
+	// queue, and observations of requests served after it are applied directly.
+	AsyncCollection bool `json:"asyncCollection,omitempty"`
+	QueueSize       int  `json:"queueSize,omitempty"`
+
+	// SeriesTTL evicts series not updated for this long, e.g. "1h". Empty keeps series forever.
+	SeriesTTL string `json:"seriesTTL,omitempty"`
+
+	// RenderCacheTTL serves the same rendered exposition to scrapes for this long, e.g. "10s",
+	// instead of rendering every series on each scrape. Scrapes may then see values up to
+	// this old, so it should stay below the scrape interval. Empty renders on every scrape.
+	RenderCacheTTL string `json:"renderCacheTTL,omitempty"`
+
+	CounterValueFromHeader  bool    `json:"counterValueFromHeader,omitempty"`  // Increment counters by the numeric header value instead of 1
+	CounterDefaultIncrement float64 `json:"counterDefaultIncrement,omitempty"` // Increment used when the header value is missing, unparsable or negative
+
+	// DefaultValue is used by histograms, summaries and gauges when no numeric header value is present.
+	// Counters are unaffected and use CounterDefaultIncrement instead.
+	DefaultValue float64 `json:"defaultValue,omitempty"`
+
+	// GaugeAggregation combines gauge observations made between scrapes: "last" (default), "max", "min" or "avg".
+	GaugeAggregation string `json:"gaugeAggregation,omitempty"`
+
+	// GaugeMode sets how gauges are updated: "set" (default) to the observed value, "add" the
+	// observed signed delta, such as "+5" or "-3", or keep the "max" or "min" ever observed. Outside
+	// "set" mode, missing or unparsable values leave gauges untouched and GaugeAggregation must be "last".
+	GaugeMode string `json:"gaugeMode,omitempty"`
+
+	// GaugeSkipMissing leaves gauges at their last known value instead of setting DefaultValue
+	// when no numeric header value is present.
+	GaugeSkipMissing bool `json:"gaugeSkipMissing,omitempty"`
+
+	// ValueRegex extracts numeric values from composite headers such as "total=123ms; db=45ms".
+	// It must have exactly one capture group, whose match is parsed instead of the whole header.
+	ValueRegex string `json:"valueRegex,omitempty"`
+
+	// HeaderExtractors maps header names to regular expressions whose first capture group
+	// becomes the label value, e.g. `^(\w+)/` to keep "ios" from "ios/5.2.1 build 9981".
+	// Values that do not match are replaced by HeaderExtractorDefault.
+	HeaderExtractors       map[string]string `json:"headerExtractors,omitempty"`
+	HeaderExtractorDefault string            `json:"headerExtractorDefault,omitempty"`
+
+	// LabelTransforms maps label header, query parameter and cookie names to transforms applied in
+	// order to their values, after header extractors and before AllowedValues: "lower", "upper", "trim",
+	// or "sha256" to pseudonymize values while keeping them grouped, optionally truncated to a number of
+	// hex characters, e.g. "sha256:12".
+	LabelTransforms map[string][]string `json:"labelTransforms,omitempty"`
+
+	// AllowedValues maps label header, query parameter and cookie names to the only values kept as is,
+	// e.g. {"X-Tenant": ["a", "b"]}, bounding the number of series. Other values become AllowedValuesOther.
+	// Values are compared after header extractors apply, case-sensitively unless AllowedValuesCaseInsensitive
+	// is set.
+	AllowedValues                map[string][]string `json:"allowedValues,omitempty"`
+	AllowedValuesOther           string              `json:"allowedValuesOther,omitempty"`
+	AllowedValuesCaseInsensitive bool                `json:"allowedValuesCaseInsensitive,omitempty"`
+
+	// MultiValueStrategy sets the label value of headers sent several times: "first" (default)
+	// keeps the first value, "join" joins every value with MultiValueSeparator and "count" uses
+	// the number of values. Header extractors apply to each value before joining. Numeric values
+	// of gauges, histograms, summaries and counters are always read from the first value.
+	MultiValueStrategy  string `json:"multiValueStrategy,omitempty"`
+	MultiValueSeparator string `json:"multiValueSeparator,omitempty"`
+
+	// HeaderSources maps header names to where labels and numeric values are read from: "request",
+	// "response", or "any" (default), which checks the request before the response. Reading headers
+	// set by the upstream from the response only keeps clients from spoofing them on the request.
+	HeaderSources map[string]string `json:"headerSources,omitempty"`
+
+	IncludeMethod bool `json:"includeMethod,omitempty"` // Add the request method as a "method" label
+	ClientIPLabel bool `json:"clientIPLabel,omitempty"` // Add the client address as a "client_ip" label
+	AnonymizeIP   bool `json:"anonymizeIP,omitempty"`   // Zero the last octet of IPv4 and the last 80 bits of IPv6 client addresses
+	IncludePath   bool `json:"includePath,omitempty"`   // Add the request path as a "path" label
+
+	// IncludeHost adds the requested host, without its port, as a "host" label. The first
+	// X-Forwarded-Host is only used when TrustForwardedHost is set, as clients can forge it.
+	IncludeHost        bool `json:"includeHost,omitempty"`
+	TrustForwardedHost bool `json:"trustForwardedHost,omitempty"`
+
+	// IncludeRemoteIP adds the address of the connecting client as a "remote_ip" label. The
+	// first X-Forwarded-For hop is only used when TrustXFF is set, as clients can forge it.
+	// RemoteIPMask and RemoteIPv6Mask bucket addresses into networks of that prefix length,
+	// e.g. 24 for IPv4 /24 networks; 0 keeps the whole address.
+	IncludeRemoteIP bool     `json:"includeRemoteIP,omitempty"`
+	TrustXFF        bool     `json:"trustXFF,omitempty"`
+	RemoteIPMask    int      `json:"remoteIPMask,omitempty"`
+	RemoteIPv6Mask  int      `json:"remoteIPv6Mask,omitempty"`
+	PathTemplates   []string `json:"pathTemplates,omitempty"`  // Templates such as "/users/{id}" or "/users/:id" that matching paths collapse to
+	PathOtherValue  string   `json:"pathOtherValue,omitempty"` // Path label value for paths matching no template
+
+	HistogramBuckets []float64 `json:"histogramBuckets,omitempty"` // Upper bounds for histogram buckets
+
+	// ValueBuckets labels each observation with the range its numeric value falls in, e.g. bounds
+	// 1024 and 65536 give "lt_1024", "1024_65536" and "gte_65536", so a counter can be broken down
+	// by size class without a histogram. Ranges include their lower bound, and observations without
+	// a numeric value get "unknown". The label is BucketLabelName, "bucket" by default.
+	ValueBuckets    []float64 `json:"valueBuckets,omitempty"`
+	BucketLabelName string    `json:"bucketLabelName,omitempty"`
+
+	// IncludePaths and ExcludePaths scope the measured requests by path prefix, e.g. "/api/", or by
+	// glob when the pattern has wildcards, e.g. "/api/*/orders". IncludeMethods scopes them by method.
+	// Exclusions win over inclusions, and empty lists include everything. Other requests pass
+	// through without any metric work, e.g. health checks excluded with ExcludePaths ["/ping"].
+	IncludePaths   []string `json:"includePaths,omitempty"`
+	ExcludePaths   []string `json:"excludePaths,omitempty"`
+	IncludeMethods []string `json:"includeMethods,omitempty"`
+
+	// StatusCodeFilter only records requests whose response status is in one of these classes,
+	// e.g. "5xx", or one of these codes, e.g. "429". Handlers that never write a status count as 200.
+	StatusCodeFilter []string `json:"statusCodeFilter,omitempty"`
+
+	MeasureDuration bool      `json:"measureDuration,omitempty"` // Record the downstream handler duration as <name>_duration_seconds
+	MeasureSize     bool      `json:"measureSize,omitempty"`     // Count body bytes as <name>_request_bytes_total and <name>_response_bytes_total
+	TrackInFlight   bool      `json:"trackInFlight,omitempty"`   // Track requests being served as a <name>_in_flight gauge
+	DurationBuckets []float64 `json:"durationBuckets,omitempty"` // Upper bounds in seconds for duration histogram buckets
+	Quantiles       []float64 `json:"quantiles,omitempty"`       // Quantiles reported by summaries
+
+	// SummaryMaxSamples caps the observations each summary series keeps to estimate its quantiles.
+	// SummaryMaxAge, e.g. "10m", computes the quantiles over a sliding window of the most recent
+	// observations instead of a sample of all of them. The _sum and _count series stay cumulative.
+	SummaryMaxSamples int    `json:"summaryMaxSamples,omitempty"`
+	SummaryMaxAge     string `json:"summaryMaxAge,omitempty"`
+
+	// ResponseSizeMetric records the bytes written to the client as a <name>_response_bytes histogram,
+	// and RequestSizeMetric the request body size as a <name>_request_bytes histogram. Bodies without a
+	// Content-Length are counted as the downstream handler reads them. They cannot be combined with
+	// MeasureSize, whose counters belong to the same OpenMetrics families.
+	ResponseSizeMetric bool      `json:"responseSizeMetric,omitempty"`
+	RequestSizeMetric  bool      `json:"requestSizeMetric,omitempty"`
+	SizeBuckets        []float64 `json:"sizeBuckets,omitempty"` // Upper bounds in bytes for size histogram buckets
+
+	// LabelTemplates adds labels whose values are text/template templates rendered per request,
+	// e.g. {"route": "{{.Method}} {{.Host}}"} or {"tenant": "{{.Header.Get \"X-Tenant\"}}"}.
+	// Templates can reference .Method, .Host, .Path and .Header. Metric names can be templates too.
+	LabelTemplates map[string]string `json:"labelTemplates,omitempty"`
+
+	// Metrics defines several metrics at once. When empty, the top-level
+	// MetricName, MetricType and MetricHeaders define a single metric.
+	Metrics []MetricDefinition `json:"metrics,omitempty"`
+}
+
+// MetricDefinition defines a single metric collected by the plugin.
+type MetricDefinition struct {
+	Name    string   `json:"name,omitempty"`
+	Type    string   `json:"type,omitempty"` // "counter", "histogram", "gauge", "summary"
+	Headers []string `json:"headers,omitempty"`
+
+	// QueryParams are query parameters used as labels. Repeated parameters use their first value.
+	QueryParams []string `json:"queryParams,omitempty"`
+
+	// Cookies are request cookies used as labels.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// ValueHeader is the header the numeric value is read from. When empty,
+	// the first numeric value among Headers is used.
+	ValueHeader string `json:"valueHeader,omitempty"`
+
+	Help string `json:"help,omitempty"` // HELP text of the metric, defaulting to DefaultMetricHelp
+}
+
+// DefaultHistogramBuckets are the default histogram bucket upper bounds.
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the default bucket upper bounds in bytes of size histograms.
+var DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1e6, 1e7, 1e8}
+
+// BasicAuth holds the credentials scrapes must send with HTTP basic auth.
+type BasicAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// TLSCertificate locates the PEM encoded certificate and private key the metrics server uses.
+type TLSCertificate struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -35,6 +402,27 @@ func CreateConfig() *Config {
 		MetricName:    "plugin_custom_requests",
 		MetricType:    MetricTypeCounter,
 		MetricsPort:   8081,
+		MetricsPath:   DefaultMetricsPath,
+
+		ExpositionFormat:  ExpositionFormatPrometheus,
+		AppendTotalSuffix: true,
+
+		HistogramBuckets: append([]float64(nil), DefaultHistogramBuckets...),
+		DurationBuckets:  append([]float64(nil), DefaultHistogramBuckets...),
+		SizeBuckets:      append([]float64(nil), DefaultSizeBuckets...),
+		Quantiles:        append([]float64(nil), DefaultSummaryQuantiles...),
+		Metrics:          []MetricDefinition{},
+		PathTemplates:    []string{},
+		PathOtherValue:   DefaultPathOtherValue,
+		MaxSeries:        DefaultMaxSeries,
+		SampleRate:       1,
+
+		CounterDefaultIncrement: 1,
+		DefaultValue:            1,
+		GaugeAggregation:        GaugeAggregationLast,
+		GaugeMode:               GaugeModeSet,
+		MultiValueStrategy:      MultiValueFirst,
+		MultiValueSeparator:     DefaultMultiValueSeparator,
 	}
 }
 
@@ -44,267 +432,2399 @@ type Metric struct {
 	Type   string            `json:"type"`
 	Value  float64           `json:"value"`
 	Labels map[string]string `json:"labels,omitempty"`
+
+	// Histogram and summary state, only populated for those metric types
+	Buckets      []float64 `json:"buckets,omitempty"`      // Bucket upper bounds
+	BucketCounts []uint64  `json:"bucketCounts,omitempty"` // Cumulative count per bucket
+	Sum          float64   `json:"sum,omitempty"`
+	Count        uint64    `json:"count,omitempty"`
+
+	LastUpdated time.Time `json:"lastUpdated"` // Time of the last observation, only populated in snapshots
+
+	help      string // HELP text, or empty for the default
+	summary   *quantileEstimator
+	quantiles []float64
+	overflow  bool      // Whether this is an overflow series for label combinations beyond the limit
+	startedAt time.Time // When the series was created or last zeroed, as the start of its cumulative values
+}
+
+// series is a metric as held in a store, with the state needed to update it concurrently.
+type series struct {
+	// Kept first so they stay 64-bit aligned for atomic access on 32-bit platforms
+	counterBits uint64 // Float64 bits of a counter's value. Accessed atomically.
+	updatedAt   int64  // Unix nanoseconds of the last observation. Accessed atomically.
+
+	Metric
+
+	// Gauge observations aggregated since the series was last read
+	windowSum   float64
+	windowCount uint64
+	gaugeSet    bool // Whether the gauge has been observed, for the max and min modes
+
+	inFlight bool // Whether this is an in-flight gauge, counting requests still being served
+
+	// Guards the values above once the series is in a store; counters are updated without it
+	mu sync.Mutex
+}
+
+// snapshot returns a point-in-time copy of the series that can be read without locking.
+// Scrapes close the gauge aggregation window, so the next observation starts a new one.
+func (m *series) snapshot(closeWindow bool) *Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if closeWindow {
+		m.windowSum = 0
+		m.windowCount = 0
+	}
+
+	snapshot := &Metric{
+		Name:        m.Name,
+		Type:        m.Type,
+		Value:       m.Value,
+		Labels:      m.Labels,
+		Buckets:     m.Buckets,
+		Sum:         m.Sum,
+		Count:       m.Count,
+		help:        m.help,
+		quantiles:   m.quantiles,
+		LastUpdated: m.lastUpdate(),
+		overflow:    m.overflow,
+		startedAt:   m.startedAt,
+	}
+	if m.Type == MetricTypeCounter {
+		snapshot.Value = m.counterValue()
+	}
+	if m.BucketCounts != nil {
+		snapshot.BucketCounts = append([]uint64(nil), m.BucketCounts...)
+	}
+	if m.summary != nil {
+		snapshot.summary = m.summary.clone()
+	}
+	return snapshot
+}
+
+// export returns a deep copy of the series for use outside the package. Unlike snapshot,
+// it leaves the gauge aggregation window open and does not share the label map.
+func (m *series) export() Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value := m.Value
+	if m.Type == MetricTypeCounter {
+		value = m.counterValue()
+	}
+	var labels map[string]string
+	if m.Labels != nil {
+		labels = make(map[string]string, len(m.Labels))
+		for labelName, labelValue := range m.Labels {
+			labels[labelName] = labelValue
+		}
+	}
+	return Metric{
+		Name:         m.Name,
+		Type:         m.Type,
+		Value:        value,
+		Labels:       labels,
+		Buckets:      append([]float64(nil), m.Buckets...),
+		BucketCounts: append([]uint64(nil), m.BucketCounts...),
+		Sum:          m.Sum,
+		Count:        m.Count,
+		LastUpdated:  m.lastUpdate(),
+	}
+}
+
+// zero resets the values of the series, keeping its labels and last update time, and reports
+// whether it did. In-flight gauges are left alone, as the requests they count still decrement them.
+// The cumulative values of the series start again at now.
+func (m *series) zero(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inFlight {
+		return false
+	}
+	atomic.StoreUint64(&m.counterBits, 0)
+	m.Value = 0
+	for i := range m.BucketCounts {
+		m.BucketCounts[i] = 0
+	}
+	m.Sum = 0
+	m.Count = 0
+	if m.summary != nil {
+		m.summary.reset()
+	}
+	m.windowSum = 0
+	m.windowCount = 0
+	m.gaugeSet = false
+	m.startedAt = now
+	return true
+}
+
+// countsRequests reports whether the series is an in-flight gauge still counting requests.
+func (m *series) countsRequests() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.inFlight && m.Value != 0
 }
 
-// MetricsStore holds all collected metrics.
-type MetricsStore struct {
-	mu      sync.RWMutex
-	metrics map[string]*Metric
+// addCounter adds a value to a counter series without taking its lock.
+func (m *series) addCounter(delta float64) {
+	for {
+		old := atomic.LoadUint64(&m.counterBits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&m.counterBits, old, updated) {
+			return
+		}
+	}
+}
+
+// counterValue returns the current value of a counter series.
+func (m *series) counterValue() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&m.counterBits))
+}
+
+// touch records the time of an observation.
+func (m *series) touch(now time.Time) {
+	atomic.StoreInt64(&m.updatedAt, now.UnixNano())
+}
+
+// lastUpdate returns the time of the last observation, or the zero time if there was none.
+func (m *series) lastUpdate() time.Time {
+	nanos := atomic.LoadInt64(&m.updatedAt)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// observe records a value into the histogram buckets or summary estimator.
+func (m *series) observe(value float64) {
+	for i, upperBound := range m.Buckets {
+		if value <= upperBound {
+			m.BucketCounts[i]++
+		}
+	}
+	if m.summary != nil {
+		m.summary.insert(value)
+	}
+	m.Sum += value
+	m.Count++
+}
+
+// updateGauge updates a gauge with an observation according to the gauge mode.
+func (m *series) updateGauge(value float64, mode, aggregation string) {
+	switch mode {
+	case GaugeModeAdd:
+		m.Value += value
+	case GaugeModeMax:
+		if !m.gaugeSet || value > m.Value {
+			m.Value = value
+		}
+	case GaugeModeMin:
+		if !m.gaugeSet || value < m.Value {
+			m.Value = value
+		}
+	default:
+		m.setGauge(value, aggregation)
+	}
+	m.gaugeSet = true
+}
+
+// setGauge combines a gauge observation with the others made since the series was last read.
+// The first observation of a window always replaces the value.
+func (m *series) setGauge(value float64, aggregation string) {
+	m.windowSum += value
+	m.windowCount++
+
+	if m.windowCount == 1 {
+		m.Value = value
+		return
+	}
+
+	switch aggregation {
+	case GaugeAggregationMax:
+		if value > m.Value {
+			m.Value = value
+		}
+	case GaugeAggregationMin:
+		if value < m.Value {
+			m.Value = value
+		}
+	case GaugeAggregationAvg:
+		m.Value = m.windowSum / float64(m.windowCount)
+	default:
+		m.Value = value
+	}
 }
 
-// responseWriter wraps http.ResponseWriter to capture response headers.
+// responseWriter wraps http.ResponseWriter to capture response headers and status code.
 type responseWriter struct {
 	http.ResponseWriter
 	headerWritten bool
+	statusCode    int
+	bytesWritten  int64
 }
 
 // WriteHeader writes the status code and ensures headers are written only once.
 func (rw *responseWriter) WriteHeader(statusCode int) {
 	if !rw.headerWritten {
 		rw.headerWritten = true
+		rw.statusCode = statusCode
 		rw.ResponseWriter.WriteHeader(statusCode)
 	}
 }
 
+// status returns the response status code, defaulting to 200 when none was written.
+func (rw *responseWriter) status() int {
+	if rw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rw.statusCode
+}
+
 // Write writes data to the response and ensures headers are written.
 func (rw *responseWriter) Write(data []byte) (int, error) {
 	if !rw.headerWritten {
 		rw.WriteHeader(http.StatusOK)
 	}
-	return rw.ResponseWriter.Write(data)
+	n, err := rw.ResponseWriter.Write(data)
+	rw.bytesWritten += int64(n)
+	return n, err
 }
 
-// CustomMetrics a custom metrics plugin.
-type CustomMetrics struct {
-	next          http.Handler
-	metricHeaders []string
-	metricName    string
-	metricType    string
-	metricsPort   int
-	name          string
-
-	// Simple metrics storage
-	store         *MetricsStore
-	server        *http.Server
-	serverStop    chan struct{}
-	serverStopped chan struct{}
+// Flush sends buffered data to the client, for streaming responses such as server-sent events.
+// It does nothing when the underlying writer cannot flush.
+func (rw *responseWriter) Flush() {
+	flusher, ok := rw.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
+	}
+	flusher.Flush()
 }
 
-// New created a new CustomMetrics plugin.
-func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.MetricHeaders) == 0 {
-		return nil, fmt.Errorf("metricHeaders cannot be empty")
+// Hijack lets the handler take over the connection, e.g. for websocket upgrades.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
 	}
+	return hijacker.Hijack()
+}
 
-	plugin := &CustomMetrics{
-		metricHeaders: config.MetricHeaders,
-		metricName:    config.MetricName,
-		metricType:    config.MetricType,
-		metricsPort:   config.MetricsPort,
-		next:          next,
-		name:          name,
-		store: &MetricsStore{
-			metrics: make(map[string]*Metric),
-		},
-		serverStop:    make(chan struct{}),
-		serverStopped: make(chan struct{}),
+// ReadFrom copies the response body from src, letting the underlying writer use sendfile when it can.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
 	}
 
-	// Metrics will be created dynamically as requests come in
-
-	// Start metrics server with port conflict detection
-	if err := plugin.startMetricsServer(); err != nil {
-		return nil, fmt.Errorf("failed to start metrics server: %w", err)
+	var n int64
+	var err error
+	if readerFrom, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(rw.ResponseWriter, src)
 	}
+	rw.bytesWritten += n
+	return n, err
+}
 
-	return plugin, nil
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
 }
 
-// Stop gracefully shuts down the metrics server.
-func (c *CustomMetrics) Stop() error {
-	if c.server != nil {
-		close(c.serverStop)
-		<-c.serverStopped // Wait for server to stop
-		return c.server.Close()
-	}
-	return nil
+// countingReader counts the bytes read from a request body of unknown length.
+type countingReader struct {
+	io.ReadCloser
+	bytesRead int64
 }
 
-// renderPrometheusFormat renders metrics in Prometheus text format.
-func (c *CustomMetrics) renderPrometheusFormat() string {
-	c.store.mu.RLock()
-	defer c.store.mu.RUnlock()
-
-	var output string
-	helpAdded := false
-
-	for _, metric := range c.store.metrics {
-		// Add HELP and TYPE comments only once per metric name
-		if !helpAdded {
-			output += fmt.Sprintf("# HELP %s Custom metric based on HTTP headers\n", metric.Name)
-			output += fmt.Sprintf("# TYPE %s %s\n", metric.Name, metric.Type)
-			helpAdded = true
-		}
-
-		// Format metric with labels
-		metricLine := metric.Name
-		if len(metric.Labels) > 0 {
-			labelPairs := make([]string, 0, len(metric.Labels))
-			for k, v := range metric.Labels {
-				labelPairs = append(labelPairs, fmt.Sprintf("%s=\"%s\"", k, v))
-			}
-			metricLine += fmt.Sprintf("{%s}", strings.Join(labelPairs, ","))
-		}
+// Read reads from the body and counts the bytes read.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytesRead += int64(n)
+	return n, err
+}
 
-		output += fmt.Sprintf("%s %.0f\n", metricLine, metric.Value)
-	}
-	return output
+// measurements are the properties of an exchange observed around the downstream handler.
+type measurements struct {
+	duration      time.Duration
+	requestBytes  int64
+	responseBytes int64
 }
 
-// startMetricsServer starts the metrics HTTP server with port conflict detection.
-func (c *CustomMetrics) startMetricsServer() error {
-	addr := fmt.Sprintf(":%d", c.metricsPort)
+// observation is what a served request contributes to one metric, resolved from the request and
+// response so it can be applied to the store without them.
+type observation struct {
+	definition MetricDefinition // With the rendered name
+	key        string
+	labels     map[string]string
+	value      float64
+	update     bool // Whether the metric itself is updated, besides the metrics derived from it
+	dropped    bool // Whether the value was dropped, not being finite or not being a number at all
+	measured   measurements
+	now        time.Time
+}
 
-	// Check if port is available (port 0 means random available port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("port %d is already in use: %w", c.metricsPort, err)
-	}
+// CustomMetrics a custom metrics plugin.
+type CustomMetrics struct {
+	handled             int32 // Whether a request was handled, for readiness. Accessed atomically.
+	readyWithoutTraffic bool
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
-		fmt.Fprint(w, c.renderPrometheusFormat())
-	})
+	next          http.Handler
+	definitions   []MetricDefinition
+	metricsPort   int
+	portFallback  bool
+	serverOptions serverOptions
+	name          string
 
-	c.server = &http.Server{
-		Addr:              addr,
-		Handler:           mux,
-		ReadHeaderTimeout: 10 * time.Second,
-	}
+	statusCodeLabel  bool
+	statusClassLabel bool
+	maxSeries        int
+	sampleRate       float64
+	counterScale     float64 // Factor applied to counter increments to make up for sampling
+	seriesTTL        time.Duration
 
-	// Start server in background with graceful shutdown
-	go func() {
-		defer close(c.serverStopped)
+	counterValueFromHeader  bool
+	counterDefaultIncrement float64
+	defaultValue            float64
+	gaugeSkipMissing        bool
+	gaugeAggregation        string
+	gaugeMode               string
+	requireAnyLabel         bool
+	headerSources           map[string]string // Keyed by canonical header name
+	valueRegex              *regexp.Regexp
 
-		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			// Log error but don't crash the plugin
-			fmt.Printf("Metrics server error: %v\n", err)
-		}
-	}()
+	// Label value extractors keyed by configured header name
+	headerExtractors       map[string]*regexp.Regexp
+	headerExtractorDefault string
 
-	return nil
-}
+	// Label value transforms keyed by configured header name
+	labelTransforms map[string][]labelTransform
 
-// getNumericValueFromHeaders extracts the first numeric value from headers, checking request first then response.
-func (c *CustomMetrics) getNumericValueFromHeaders(req *http.Request, responseHeaders http.Header) float64 {
-	// Check request headers first
-	for _, headerName := range c.metricHeaders {
-		if headerValue := req.Header.Get(headerName); headerValue != "" {
-			if parsedValue, err := strconv.ParseFloat(headerValue, 64); err == nil {
-				return parsedValue
-			}
-		}
-	}
+	// Allowed label values keyed by configured header name, mapping each accepted
+	// value, lower-cased when matching ignores case, to its configured spelling
+	allowedValues          map[string]map[string]string
+	allowedValuesOther     string
+	allowedCaseInsensitive bool
+	multiValueStrategy     string
+	multiValueSeparator    string
+	includeMethod          bool
+	clientIPLabel          bool
+	anonymizeIP            bool
+	includeRemoteIP        bool
+	trustXFF               bool
+	remoteIPMask           int
+	remoteIPv6Mask         int
+	includePath            bool
+	includeHost            bool
+	trustForwardedHost     bool
+	pathTemplates          []pathTemplate
+	includePaths           []pathFilter
+	excludePaths           []pathFilter
+	includeMethods         map[string]bool
+	statusFilter           *statusFilter
+	pathOtherValue         string
 
-	// Check response headers if no numeric value found in request
-	for _, headerName := range c.metricHeaders {
-		if headerValue := responseHeaders.Get(headerName); headerValue != "" {
-			if parsedValue, err := strconv.ParseFloat(headerValue, 64); err == nil {
-				return parsedValue
-			}
-		}
-	}
+	histogramBuckets  []float64
+	valueBuckets      *valueBuckets
+	bucketLabelName   string
+	quantiles         []float64
+	summaryMaxSamples int
+	summaryMaxAge     time.Duration
 
-	return 1 // Default value
-}
+	measureDuration bool
+	measureSize     bool
+	trackInFlight   bool
+	durationBuckets []float64
 
-// createMetricKey creates a unique key for a metric with labels.
-func (c *CustomMetrics) createMetricKey(metricName string, labels map[string]string) string {
-	key := metricName
-	for k, v := range labels {
-		key += fmt.Sprintf("_%s_%s", k, v)
-	}
-	return key
-}
+	responseSizeMetric bool
+	requestSizeMetric  bool
+	sizeBuckets        []float64
 
-// sanitizePrometheusLabelName converts header names to valid Prometheus label names.
-// Prometheus label names must match [a-zA-Z_][a-zA-Z0-9_]*.
-func sanitizePrometheusLabelName(headerName string) string {
-	// Replace hyphens with underscores
-	sanitized := strings.ReplaceAll(headerName, "-", "_")
+	// Labels added to every series when it is created
+	constLabels map[string]string
 
-	// Replace any other invalid characters with underscores
-	reg := regexp.MustCompile(`[^a-zA-Z0-9_]`)
-	sanitized = reg.ReplaceAllString(sanitized, "_")
+	// Templates rendering metric names, keyed by the configured name, and label values per request
+	nameTemplates  map[string]*nameTemplate
+	labelTemplates []labelTemplate
 
-	// Ensure it starts with a letter or underscore
-	if len(sanitized) > 0 && sanitized[0] >= '0' && sanitized[0] <= '9' {
-		sanitized = "_" + sanitized
-	}
+	// Sanitized label name for each configured header, query parameter and cookie
+	labelNames      map[string]string
+	omitEmptyLabels bool
+	useQuery        bool // Whether any metric takes labels from query parameters
 
-	// Convert to lowercase for consistency
-	return strings.ToLower(sanitized)
+	// Clock used to timestamp series, replaceable in tests
+	now func() time.Time
+
+	// Simple metrics storage
+	store       *MetricsStore
+	server      *sharedServer
+	handler     http.Handler // Serves the metrics endpoints when the server is disabled
+	statsd      *statsdClient
+	otlp        *otlpExporter
+	pushgateway *pushgatewayPusher
+	collector   *asyncCollector // Applies observations in the background with AsyncCollection
+	serverStop  chan struct{}   // Closed by Stop to end the sweeper, exporters and context watcher
+	stopOnce    sync.Once
 }
 
-// collectMetrics collects metrics for every request, using header values as labels.
-func (c *CustomMetrics) collectMetrics(req *http.Request, responseHeaders http.Header) {
-	c.store.mu.Lock()
-	defer c.store.mu.Unlock()
+// New created a new CustomMetrics plugin.
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	definitions := config.Metrics
+	if len(definitions) == 0 {
+		if len(config.MetricHeaders) == 0 && len(config.MetricQueryParams) == 0 && len(config.MetricCookies) == 0 &&
+			!(config.AllowNoLabels && config.MetricType == MetricTypeCounter) {
+			return nil, fmt.Errorf("metricHeaders cannot be empty unless allowNoLabels is set for a counter")
+		}
 
-	// Collect header values as labels
-	labels := make(map[string]string)
-	for _, headerName := range c.metricHeaders {
-		// Sanitize header name for Prometheus label compatibility
-		labelName := sanitizePrometheusLabelName(headerName)
+		// Fold the top-level fields into a single implicit definition
+		definitions = []MetricDefinition{{
+			Name:        config.MetricName,
+			Type:        config.MetricType,
+			Help:        config.MetricHelp,
+			Headers:     config.MetricHeaders,
+			QueryParams: config.MetricQueryParams,
+			Cookies:     config.MetricCookies,
+		}}
+	}
+	names := make(map[string]bool, len(definitions))
+	nameTemplates := make(map[string]*nameTemplate)
+	for i, definition := range definitions {
+		// Name the offending fields as configured
+		nameField, typeField := "metricName", "metricType"
+		if len(config.Metrics) > 0 {
+			nameField, typeField = fmt.Sprintf("metrics[%d].name", i), fmt.Sprintf("metrics[%d].type", i)
+		}
 
-		// Check request headers first
-		if value := req.Header.Get(headerName); value != "" {
-			labels[labelName] = value
-		} else if value := responseHeaders.Get(headerName); value != "" {
-			// Check response headers if not found in request
-			labels[labelName] = value
-		} else {
-			// Use empty string for missing headers
-			labels[labelName] = ""
+		if definition.Name == "" {
+			return nil, fmt.Errorf("%s cannot be empty", nameField)
+		}
+		if isTemplate(definition.Name) {
+			// Rendered names are sanitized per request
+			nameTemplate, err := parseNameTemplate(definition.Name)
+			if err != nil {
+				return nil, err
+			}
+			nameTemplates[definition.Name] = nameTemplate
+		} else if !validMetricName.MatchString(definition.Name) {
+			return nil, fmt.Errorf("invalid %s %q, must match %s", nameField, definition.Name, validMetricName)
+		}
+		if strings.HasPrefix(definition.Name, reservedMetricPrefix) {
+			return nil, fmt.Errorf("invalid %s %q, the %s prefix is reserved for the metrics about the plugin", nameField, definition.Name, reservedMetricPrefix)
 		}
+		switch definition.Type {
+		case MetricTypeCounter, MetricTypeHistogram, MetricTypeGauge, MetricTypeSummary:
+		default:
+			return nil, fmt.Errorf("invalid %s %q for metric %q, must be one of %q, %q, %q or %q",
+				typeField, definition.Type, definition.Name, MetricTypeCounter, MetricTypeHistogram, MetricTypeGauge, MetricTypeSummary)
+		}
+		// Without labels, only counters and metrics reading a value header have something to record
+		if len(definition.Headers) == 0 && len(definition.QueryParams) == 0 && len(definition.Cookies) == 0 &&
+			!(config.AllowNoLabels && (definition.Type == MetricTypeCounter || definition.ValueHeader != "")) {
+			return nil, fmt.Errorf("headers cannot be empty for metric %q unless allowNoLabels is set for a counter or a metric with a valueHeader", definition.Name)
+		}
+		if names[definition.Name] {
+			return nil, fmt.Errorf("duplicate metric name %q", definition.Name)
+		}
+		names[definition.Name] = true
 	}
 
-	// Create a unique metric key based on labels
-	metricKey := c.metricName
-	if len(labels) > 0 {
-		metricKey = c.createMetricKey(c.metricName, labels)
+	// Names rendered from templates must stay out of the families of the other metrics, starting
+	// with those of the fixed names and of the names templates fall back to
+	families := newMetricFamilies(config)
+	for _, definition := range definitions {
+		if nameTemplates[definition.Name] == nil && !families.claim(definition.Name, definition.Name, definition.Type) {
+			return nil, fmt.Errorf("metric %q collides with the family of another metric", definition.Name)
+		}
 	}
-
-	// Get or create metric with labels
-	metric := c.store.metrics[metricKey]
-	if metric == nil {
-		metric = &Metric{
-			Name:   c.metricName,
-			Type:   c.metricType,
-			Value:  0,
-			Labels: labels,
+	for _, definition := range definitions {
+		if nameTemplate := nameTemplates[definition.Name]; nameTemplate != nil {
+			if !families.claim(definition.Name, nameTemplate.fallback, definition.Type) {
+				return nil, fmt.Errorf("fallback name %q of metric %q collides with the family of another metric", nameTemplate.fallback, definition.Name)
+			}
+			nameTemplate.families = families
+			nameTemplate.metricType = definition.Type
 		}
-		c.store.metrics[metricKey] = metric
 	}
 
-	// Update metric value
-	switch c.metricType {
-	case MetricTypeCounter:
-		metric.Value++ // Count every request
-	case MetricTypeHistogram, MetricTypeGauge:
-		metric.Value = c.getNumericValueFromHeaders(req, responseHeaders)
+	if config.MetricsPort < 0 || config.MetricsPort > 65535 {
+		return nil, fmt.Errorf("invalid metricsPort %d, must be 0 or within 1-65535", config.MetricsPort)
 	}
-}
 
-// ServeHTTP processes HTTP requests and collects metrics based on both request and response headers.
-func (c *CustomMetrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// Wrap the response writer to capture response headers
-	wrappedRW := &responseWriter{ResponseWriter: rw}
+	histogramBuckets, err := normalizeBuckets(config.HistogramBuckets)
+	if err != nil {
+		return nil, err
+	}
 
-	// Pass request to next handler with wrapped response writer
+	durationBuckets, err := normalizeBuckets(config.DurationBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	sizeBuckets := config.SizeBuckets
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = DefaultSizeBuckets
+	}
+	sizeBuckets, err = normalizeBuckets(sizeBuckets)
+	if err != nil {
+		return nil, err
+	}
+	if config.ResponseSizeMetric && config.MeasureSize {
+		return nil, fmt.Errorf("responseSizeMetric cannot be combined with measureSize, which already counts response bytes")
+	}
+	if config.RequestSizeMetric && config.MeasureSize {
+		return nil, fmt.Errorf("requestSizeMetric cannot be combined with measureSize, which already counts request bytes")
+	}
+
+	quantiles := config.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = DefaultSummaryQuantiles
+	}
+	for _, q := range quantiles {
+		if q < 0 || q > 1 || math.IsNaN(q) {
+			return nil, fmt.Errorf("quantile %v must be within [0, 1]", q)
+		}
+	}
+
+	summaryMaxSamples := config.SummaryMaxSamples
+	if summaryMaxSamples == 0 {
+		summaryMaxSamples = defaultSummaryMaxSamples
+	}
+	if summaryMaxSamples < 0 {
+		return nil, fmt.Errorf("summaryMaxSamples must be positive, got %d", config.SummaryMaxSamples)
+	}
+
+	var summaryMaxAge time.Duration
+	if config.SummaryMaxAge != "" {
+		summaryMaxAge, err = time.ParseDuration(config.SummaryMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid summaryMaxAge: %w", err)
+		}
+		if summaryMaxAge <= 0 {
+			return nil, fmt.Errorf("summaryMaxAge must be positive, got %s", config.SummaryMaxAge)
+		}
+	}
+
+	pathTemplates := make([]pathTemplate, 0, len(config.PathTemplates))
+	for _, template := range config.PathTemplates {
+		parsed, err := parsePathTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		pathTemplates = append(pathTemplates, parsed)
+	}
+
+	if config.RemoteIPMask < 0 || config.RemoteIPMask > 32 {
+		return nil, fmt.Errorf("remoteIPMask must be between 0 and 32, got %d", config.RemoteIPMask)
+	}
+	if config.RemoteIPv6Mask < 0 || config.RemoteIPv6Mask > 128 {
+		return nil, fmt.Errorf("remoteIPv6Mask must be between 0 and 128, got %d", config.RemoteIPv6Mask)
+	}
+
+	var buckets *valueBuckets
+	bucketLabelName := config.BucketLabelName
+	if len(config.ValueBuckets) > 0 {
+		buckets, err = parseValueBuckets(config.ValueBuckets)
+		if err != nil {
+			return nil, err
+		}
+		if bucketLabelName == "" {
+			bucketLabelName = DefaultBucketLabelName
+		}
+		if !validLabelName.MatchString(bucketLabelName) || strings.HasPrefix(bucketLabelName, "__") {
+			return nil, fmt.Errorf("invalid bucketLabelName %q", bucketLabelName)
+		}
+	} else if bucketLabelName != "" {
+		return nil, fmt.Errorf("bucketLabelName requires valueBuckets")
+	}
+
+	pathOtherValue := config.PathOtherValue
+	if pathOtherValue == "" {
+		pathOtherValue = DefaultPathOtherValue
+	}
+
+	labelNames := make(map[string]string)
+	derivedLabels := make(map[string]string) // Describes the first source of each label name
+	var useQuery bool
+	for _, definition := range definitions {
+		// Describes the source of each label of the metric, to detect sources sharing a label name
+		sources := make(map[string]string)
+		claim := func(kind, source string) error {
+			labelName := source
+			if !config.DisableLabelSanitization {
+				labelName = sanitizePrometheusLabelName(source)
+			}
+			labelNames[source] = labelName
+
+			description := fmt.Sprintf("%s %q", kind, source)
+			if other, ok := sources[labelName]; ok && other != description {
+				return fmt.Errorf("%s and %s both map to label %q in metric %q", other, description, labelName, definition.Name)
+			}
+			sources[labelName] = description
+			if _, ok := derivedLabels[labelName]; !ok {
+				derivedLabels[labelName] = description
+			}
+			return nil
+		}
+
+		for _, headerName := range definition.Headers {
+			if err := claim("header", headerName); err != nil {
+				return nil, err
+			}
+		}
+		for _, param := range definition.QueryParams {
+			if err := claim("query parameter", param); err != nil {
+				return nil, err
+			}
+			useQuery = true
+		}
+		for _, cookie := range definition.Cookies {
+			if err := claim("cookie", cookie); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Labels added from the request itself count as derived too. Headers, query parameters and
+	// cookies mapping to one of them would silently replace its value, so they are rejected, and
+	// so are label templates
+	for _, builtin := range []struct {
+		enabled bool
+		name    string
+		option  string
+	}{
+		{config.StatusCodeLabel, "status", "statusCodeLabel"},
+		{config.StatusClassLabel, "status_class", "statusClassLabel"},
+		{config.IncludeMethod, "method", "includeMethod"},
+		{config.IncludePath, "path", "includePath"},
+		{config.IncludeHost, "host", "includeHost"},
+		{config.ClientIPLabel, "client_ip", "clientIPLabel"},
+		{config.IncludeRemoteIP, "remote_ip", "includeRemoteIP"},
+	} {
+		if !builtin.enabled {
+			continue
+		}
+		if source, ok := derivedLabels[builtin.name]; ok {
+			return nil, fmt.Errorf("%s and %s both map to label %q", source, builtin.option, builtin.name)
+		}
+		derivedLabels[builtin.name] = builtin.option
+	}
+	if buckets != nil {
+		if source, ok := derivedLabels[bucketLabelName]; ok {
+			return nil, fmt.Errorf("bucketLabelName %q collides with the label derived from %s", bucketLabelName, source)
+		}
+		derivedLabels[bucketLabelName] = "valueBuckets"
+	}
+
+	constLabels := make(map[string]string, len(config.ConstLabels))
+	constSources := make(map[string]string, len(config.ConstLabels))
+	for name, value := range config.ConstLabels {
+		labelName := name
+		if !config.DisableLabelSanitization {
+			labelName = sanitizePrometheusLabelName(name)
+		}
+		if !validLabelName.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+			return nil, fmt.Errorf("invalid const label name %q", name)
+		}
+		if other, ok := constSources[labelName]; ok {
+			return nil, fmt.Errorf("const labels %q and %q both map to label %q", other, name, labelName)
+		}
+		constSources[labelName] = name
+		constLabels[labelName] = value
+	}
+
+	labelTemplates, err := parseLabelTemplates(config.LabelTemplates)
+	if err != nil {
+		return nil, err
+	}
+	for _, labelTemplate := range labelTemplates {
+		if source, ok := derivedLabels[labelTemplate.name]; ok {
+			return nil, fmt.Errorf("label template %q collides with the label derived from %s", labelTemplate.name, source)
+		}
+	}
+
+	headerExtractors := make(map[string]*regexp.Regexp, len(config.HeaderExtractors))
+	for extractedHeader, pattern := range config.HeaderExtractors {
+		extractor, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid headerExtractors pattern for %s: %w", extractedHeader, err)
+		}
+		if extractor.NumSubexp() == 0 {
+			return nil, fmt.Errorf("headerExtractors pattern for %s must have a capture group", extractedHeader)
+		}
+
+		// Header names are case-insensitive, so match them against the configured label headers canonically
+		var used bool
+		for _, definition := range definitions {
+			for _, headerName := range definition.Headers {
+				if http.CanonicalHeaderKey(headerName) == http.CanonicalHeaderKey(extractedHeader) {
+					headerExtractors[headerName] = extractor
+					used = true
+				}
+			}
+		}
+		if !used {
+			return nil, fmt.Errorf("headerExtractors references %s, which is not a label header", extractedHeader)
+		}
+	}
+
+	metricsPath := config.MetricsPath
+	if metricsPath == "" {
+		metricsPath = DefaultMetricsPath
+	}
+	if !strings.HasPrefix(metricsPath, "/") {
+		return nil, fmt.Errorf("metricsPath must start with /, got %q", metricsPath)
+	}
+
+	// Addresses are compared by instances sharing a port, so they are kept in canonical form
+	var metricsAddress string
+	if config.MetricsAddress != "" {
+		host := strings.TrimSuffix(strings.TrimPrefix(config.MetricsAddress, "["), "]")
+		if _, _, err := net.SplitHostPort(config.MetricsAddress); err == nil {
+			return nil, fmt.Errorf("metricsAddress cannot include a port, set metricsPort instead, got %q", config.MetricsAddress)
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			metricsAddress = ip.String()
+		} else if validHostName.MatchString(host) {
+			metricsAddress = strings.ToLower(strings.TrimSuffix(host, "."))
+		} else {
+			return nil, fmt.Errorf("metricsAddress must be an IP address or a host name, got %q", config.MetricsAddress)
+		}
+	}
+
+	format := config.ExpositionFormat
+	if format == "" {
+		format = ExpositionFormatPrometheus
+	}
+	if format != ExpositionFormatPrometheus && format != ExpositionFormatOpenMetrics {
+		return nil, fmt.Errorf("expositionFormat must be %q or %q, got %q", ExpositionFormatPrometheus, ExpositionFormatOpenMetrics, format)
+	}
+
+	if config.MaxSeries < 0 {
+		return nil, fmt.Errorf("maxSeries cannot be negative, got %d", config.MaxSeries)
+	}
+
+	var seriesTTL time.Duration
+	if config.SeriesTTL != "" {
+		seriesTTL, err = time.ParseDuration(config.SeriesTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seriesTTL: %w", err)
+		}
+		if seriesTTL <= 0 {
+			return nil, fmt.Errorf("seriesTTL must be positive, got %s", config.SeriesTTL)
+		}
+	}
+
+	if config.MetricsAuth.Username == "" && config.MetricsAuth.Password != "" {
+		return nil, fmt.Errorf("metricsAuth requires a username")
+	}
+	if config.MetricsAuth.Username != "" && config.MetricsAuthToken != "" {
+		return nil, fmt.Errorf("metricsAuth and metricsAuthToken cannot both be set")
+	}
+
+	allowedNetworks, err := parseCIDRs(config.MetricsAllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificate *tls.Certificate
+	if config.MetricsTLS.CertFile != "" || config.MetricsTLS.KeyFile != "" {
+		if config.MetricsTLS.CertFile == "" || config.MetricsTLS.KeyFile == "" {
+			return nil, fmt.Errorf("metricsTLS requires both certFile and keyFile")
+		}
+		loaded, err := tls.LoadX509KeyPair(config.MetricsTLS.CertFile, config.MetricsTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metricsTLS certificate: %w", err)
+		}
+		certificate = &loaded
+	}
+
+	var otlp *otlpExporter
+	if config.OTLPEndpoint != "" {
+		endpoint, err := url.Parse(config.OTLPEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("otlpEndpoint must be an http or https URL, got %q", config.OTLPEndpoint)
+		}
+
+		interval := DefaultOTLPInterval
+		if config.OTLPInterval != "" {
+			interval, err = time.ParseDuration(config.OTLPInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid otlpInterval: %w", err)
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("otlpInterval must be positive, got %s", config.OTLPInterval)
+			}
+		}
+
+		otlp = &otlpExporter{
+			endpoint: config.OTLPEndpoint,
+			interval: interval,
+			client:   &http.Client{Timeout: otlpTimeout},
+			stopped:  make(chan struct{}),
+		}
+	}
+
+	var pushgateway *pushgatewayPusher
+	if config.PushgatewayURL != "" {
+		gatewayURL, err := url.Parse(config.PushgatewayURL)
+		if err != nil || (gatewayURL.Scheme != "http" && gatewayURL.Scheme != "https") || gatewayURL.Host == "" {
+			return nil, fmt.Errorf("pushgatewayURL must be an http or https URL, got %q", config.PushgatewayURL)
+		}
+
+		interval := DefaultPushInterval
+		if config.PushInterval != "" {
+			interval, err = time.ParseDuration(config.PushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pushInterval: %w", err)
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("pushInterval must be positive, got %s", config.PushInterval)
+			}
+		}
+
+		job := config.PushgatewayJob
+		if job == "" {
+			job = DefaultPushgatewayJob
+		}
+
+		pushgateway = &pushgatewayPusher{
+			url:      pushgatewayGroupingURL(config.PushgatewayURL, job, name),
+			interval: interval,
+			client:   &http.Client{Timeout: pushTimeout},
+			stopped:  make(chan struct{}),
+		}
+	}
+
+	var renderCacheTTL time.Duration
+	if config.RenderCacheTTL != "" {
+		renderCacheTTL, err = time.ParseDuration(config.RenderCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renderCacheTTL: %w", err)
+		}
+		if renderCacheTTL <= 0 {
+			return nil, fmt.Errorf("renderCacheTTL must be positive, got %s", config.RenderCacheTTL)
+		}
+	}
+
+	if config.CounterDefaultIncrement < 0 || math.IsNaN(config.CounterDefaultIncrement) || math.IsInf(config.CounterDefaultIncrement, 0) {
+		return nil, fmt.Errorf("counterDefaultIncrement must be a non-negative number, got %v", config.CounterDefaultIncrement)
+	}
+
+	gaugeAggregation := config.GaugeAggregation
+	switch gaugeAggregation {
+	case "":
+		gaugeAggregation = GaugeAggregationLast
+	case GaugeAggregationLast, GaugeAggregationMax, GaugeAggregationMin, GaugeAggregationAvg:
+	default:
+		return nil, fmt.Errorf("gaugeAggregation must be one of last, max, min or avg, got %q", gaugeAggregation)
+	}
+
+	labelTransforms := make(map[string][]labelTransform, len(config.LabelTransforms))
+	for transformedHeader, names := range config.LabelTransforms {
+		transforms, err := parseLabelTransforms(names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labelTransforms for %s: %w", transformedHeader, err)
+		}
+
+		sources := labelSources(definitions, transformedHeader)
+		if len(sources) == 0 {
+			return nil, fmt.Errorf("labelTransforms references %s, which is not a label header, query parameter or cookie", transformedHeader)
+		}
+		for _, source := range sources {
+			labelTransforms[source] = transforms
+		}
+	}
+
+	allowedValues := make(map[string]map[string]string, len(config.AllowedValues))
+	for allowedHeader, values := range config.AllowedValues {
+		accepted := make(map[string]string, len(values))
+		for _, value := range values {
+			key := value
+			if config.AllowedValuesCaseInsensitive {
+				key = strings.ToLower(value)
+			}
+			accepted[key] = value
+		}
+
+		sources := labelSources(definitions, allowedHeader)
+		if len(sources) == 0 {
+			return nil, fmt.Errorf("allowedValues references %s, which is not a label header, query parameter or cookie", allowedHeader)
+		}
+		for _, source := range sources {
+			allowedValues[source] = accepted
+		}
+	}
+	allowedValuesOther := config.AllowedValuesOther
+	if allowedValuesOther == "" {
+		allowedValuesOther = DefaultAllowedValuesOther
+	}
+
+	headerSources := make(map[string]string, len(config.HeaderSources))
+	for headerName, source := range config.HeaderSources {
+		switch source {
+		case HeaderSourceAny, HeaderSourceRequest, HeaderSourceResponse:
+		default:
+			return nil, fmt.Errorf("headerSources for %s must be one of any, request or response, got %q", headerName, source)
+		}
+		headerSources[http.CanonicalHeaderKey(headerName)] = source
+	}
+
+	gaugeMode := config.GaugeMode
+	switch gaugeMode {
+	case "":
+		gaugeMode = GaugeModeSet
+	case GaugeModeSet, GaugeModeAdd, GaugeModeMax, GaugeModeMin:
+	default:
+		return nil, fmt.Errorf("gaugeMode must be one of set, add, max or min, got %q", gaugeMode)
+	}
+	if gaugeMode != GaugeModeSet && gaugeAggregation != GaugeAggregationLast {
+		return nil, fmt.Errorf("gaugeAggregation %q only applies to the set gauge mode, not %q", gaugeAggregation, gaugeMode)
+	}
+
+	multiValueStrategy := config.MultiValueStrategy
+	switch multiValueStrategy {
+	case "":
+		multiValueStrategy = MultiValueFirst
+	case MultiValueFirst, MultiValueJoin, MultiValueCount:
+	default:
+		return nil, fmt.Errorf("multiValueStrategy must be one of first, join or count, got %q", multiValueStrategy)
+	}
+	multiValueSeparator := config.MultiValueSeparator
+	if multiValueSeparator == "" {
+		multiValueSeparator = DefaultMultiValueSeparator
+	}
+
+	sampleRate := config.SampleRate
+	if !(sampleRate > 0 && sampleRate <= 1) {
+		return nil, fmt.Errorf("sampleRate must be within (0, 1], got %v", config.SampleRate)
+	}
+	counterScale := 1.0
+	if config.ScaleSampledCounters {
+		counterScale = 1 / sampleRate
+	}
+
+	var collector *asyncCollector
+	if config.AsyncCollection {
+		queueSize := config.QueueSize
+		if queueSize == 0 {
+			queueSize = DefaultQueueSize
+		}
+		if queueSize < 0 {
+			return nil, fmt.Errorf("queueSize must be positive, got %d", config.QueueSize)
+		}
+		collector = newAsyncCollector(queueSize)
+	} else if config.QueueSize != 0 {
+		return nil, fmt.Errorf("queueSize requires asyncCollection")
+	}
+
+	includePaths, err := parsePathFilters("includePaths", config.IncludePaths)
+	if err != nil {
+		return nil, err
+	}
+	excludePaths, err := parsePathFilters("excludePaths", config.ExcludePaths)
+	if err != nil {
+		return nil, err
+	}
+	includeMethods := make(map[string]bool, len(config.IncludeMethods))
+	for _, method := range config.IncludeMethods {
+		includeMethods[strings.ToUpper(method)] = true
+	}
+	statusFilter, err := parseStatusFilter(config.StatusCodeFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var valueRegex *regexp.Regexp
+	if config.ValueRegex != "" {
+		valueRegex, err = regexp.Compile(config.ValueRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid valueRegex: %w", err)
+		}
+		if valueRegex.NumSubexp() != 1 {
+			return nil, fmt.Errorf("valueRegex must have exactly one capture group, got %d", valueRegex.NumSubexp())
+		}
+	}
+
+	plugin := &CustomMetrics{
+		definitions:  definitions,
+		metricsPort:  config.MetricsPort,
+		portFallback: config.PortFallback,
+		serverOptions: serverOptions{
+			address: metricsAddress,
+			path:    metricsPath,
+			format:  format,
+
+			appendTotalSuffix: config.AppendTotalSuffix,
+			authToken:         config.MetricsAuthToken,
+			basicAuth:         config.MetricsAuth,
+			allowedNetworks:   allowedNetworks,
+			tlsFiles:          config.MetricsTLS,
+			certificate:       certificate,
+			renderCacheTTL:    renderCacheTTL,
+			enableReset:       config.EnableReset,
+		},
+		statusCodeLabel:         config.StatusCodeLabel,
+		statusClassLabel:        config.StatusClassLabel,
+		maxSeries:               config.MaxSeries,
+		sampleRate:              sampleRate,
+		counterScale:            counterScale,
+		seriesTTL:               seriesTTL,
+		now:                     time.Now,
+		counterValueFromHeader:  config.CounterValueFromHeader,
+		counterDefaultIncrement: config.CounterDefaultIncrement,
+		defaultValue:            config.DefaultValue,
+		gaugeSkipMissing:        config.GaugeSkipMissing,
+		gaugeAggregation:        gaugeAggregation,
+		gaugeMode:               gaugeMode,
+		requireAnyLabel:         config.RequireAnyLabel,
+		readyWithoutTraffic:     config.ReadyWithoutTraffic,
+		headerSources:           headerSources,
+		valueRegex:              valueRegex,
+		headerExtractors:        headerExtractors,
+		headerExtractorDefault:  config.HeaderExtractorDefault,
+		labelTransforms:         labelTransforms,
+		allowedValues:           allowedValues,
+		allowedValuesOther:      allowedValuesOther,
+		allowedCaseInsensitive:  config.AllowedValuesCaseInsensitive,
+		multiValueStrategy:      multiValueStrategy,
+		multiValueSeparator:     multiValueSeparator,
+		includeMethod:           config.IncludeMethod,
+		clientIPLabel:           config.ClientIPLabel,
+		anonymizeIP:             config.AnonymizeIP,
+		includeRemoteIP:         config.IncludeRemoteIP,
+		trustXFF:                config.TrustXFF,
+		remoteIPMask:            config.RemoteIPMask,
+		remoteIPv6Mask:          config.RemoteIPv6Mask,
+		includePath:             config.IncludePath,
+		includeHost:             config.IncludeHost,
+		trustForwardedHost:      config.TrustForwardedHost,
+		pathTemplates:           pathTemplates,
+		includePaths:            includePaths,
+		excludePaths:            excludePaths,
+		includeMethods:          includeMethods,
+		statusFilter:            statusFilter,
+		pathOtherValue:          pathOtherValue,
+		next:                    next,
+		histogramBuckets:        histogramBuckets,
+		valueBuckets:            buckets,
+		bucketLabelName:         bucketLabelName,
+		measureDuration:         config.MeasureDuration,
+		measureSize:             config.MeasureSize,
+		trackInFlight:           config.TrackInFlight,
+		durationBuckets:         durationBuckets,
+		responseSizeMetric:      config.ResponseSizeMetric,
+		requestSizeMetric:       config.RequestSizeMetric,
+		sizeBuckets:             sizeBuckets,
+		quantiles:               quantiles,
+		summaryMaxSamples:       summaryMaxSamples,
+		summaryMaxAge:           summaryMaxAge,
+		useQuery:                useQuery,
+		constLabels:             constLabels,
+		omitEmptyLabels:         config.OmitEmptyLabels,
+		nameTemplates:           nameTemplates,
+		labelTemplates:          labelTemplates,
+		labelNames:              labelNames,
+		name:                    name,
+		store:                   newMetricsStore(),
+		serverStop:              make(chan struct{}),
+	}
+
+	// Metrics will be created dynamically as requests come in, next to those about the plugin itself
+	if !config.DisableSelfMetrics {
+		plugin.store.enableInternalMetrics(plugin.withConstLabels(map[string]string{"plugin": name}))
+	}
+
+	// Start metrics server with port conflict detection
+	if config.DisableServer {
+		plugin.handler = newMetricsHandler(func() []*MetricsStore { return []*MetricsStore{plugin.store} }, plugin.ready, plugin.serverOptions)
+	} else if err := plugin.startMetricsServer(); err != nil {
+		return nil, fmt.Errorf("failed to start metrics server: %w", err)
+	}
+
+	if config.StatsDAddress != "" {
+		plugin.statsd, err = newStatsDClient(config.StatsDAddress)
+		if err != nil {
+			_ = plugin.Stop()
+			return nil, err
+		}
+	}
+
+	if plugin.seriesTTL > 0 {
+		go plugin.runSweeper()
+	}
+
+	if otlp != nil {
+		plugin.otlp = otlp
+		go plugin.runOTLPExporter()
+	}
+
+	if pushgateway != nil {
+		plugin.pushgateway = pushgateway
+		go plugin.runPushgatewayPusher()
+	}
+
+	if collector != nil {
+		plugin.collector = collector
+		go plugin.runCollector()
+	}
+
+	// Stop when Traefik tears the middleware down
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = plugin.Stop()
+		case <-plugin.serverStop:
+		}
+	}()
+
+	return plugin, nil
+}
+
+// Stop detaches the plugin from its metrics server, shutting the server down
+// once no other instance uses it. Observations queued by AsyncCollection are applied first.
+func (c *CustomMetrics) Stop() error {
+	var err error
+	c.stopOnce.Do(func() {
+		// Apply the queued observations first, so the last export and push include them
+		if c.collector != nil {
+			c.stopCollector()
+		}
+		close(c.serverStop)
+		if c.otlp != nil {
+			<-c.otlp.stopped // Wait for the last export
+		}
+		if c.pushgateway != nil {
+			<-c.pushgateway.stopped // Wait for the last push
+		}
+		if c.server != nil {
+			err = c.server.release(c)
+		}
+		if c.statsd != nil {
+			if closeErr := c.statsd.close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// normalizeBuckets returns a sorted copy of the histogram bucket upper bounds, or the defaults when none are given.
+// An explicit +Inf bound is dropped since the +Inf bucket is always rendered.
+func normalizeBuckets(buckets []float64) ([]float64, error) {
+	if len(buckets) == 0 {
+		return DefaultHistogramBuckets, nil
+	}
+
+	sorted := make([]float64, 0, len(buckets))
+	for _, upperBound := range buckets {
+		if math.IsNaN(upperBound) {
+			return nil, fmt.Errorf("histogram bucket upper bound cannot be NaN")
+		}
+		if !math.IsInf(upperBound, 1) {
+			sorted = append(sorted, upperBound)
+		}
+	}
+	sort.Float64s(sorted)
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return nil, fmt.Errorf("duplicate histogram bucket upper bound %v", sorted[i])
+		}
+	}
+
+	return sorted, nil
+}
+
+// renderPrometheusFormat renders metrics in Prometheus text format.
+func (c *CustomMetrics) renderPrometheusFormat() string {
+	var output strings.Builder
+	_ = c.writePrometheusFormat(&output)
+	return output.String()
+}
+
+// renderOpenMetricsFormat renders metrics in OpenMetrics text format.
+func (c *CustomMetrics) renderOpenMetricsFormat() string {
+	options := c.serverOptions
+	options.format = ExpositionFormatOpenMetrics
+	return renderStores([]*MetricsStore{c.store}, options, true)
+}
+
+// writePrometheusFormat writes metrics in Prometheus text format to w.
+func (c *CustomMetrics) writePrometheusFormat(w io.Writer) error {
+	options := c.serverOptions
+	options.format = ExpositionFormatPrometheus
+	return writeStores(w, []*MetricsStore{c.store}, options, true)
+}
+
+// renderStores renders the union of the metrics held by several stores in the exposition format of the options.
+func renderStores(stores []*MetricsStore, options serverOptions, scrape bool) string {
+	var output strings.Builder
+	_ = writeStores(&output, stores, options, scrape)
+	return output.String()
+}
+
+// writeStores writes the union of the metrics held by several stores to w in the exposition format of the options.
+// The stores are only locked while they are snapshotted, not while the exposition is written.
+// Only scrapes close the gauge aggregation windows, so pushes leave them to the next scrape.
+//
+// In OpenMetrics, counter samples carry the mandatory _total suffix while HELP and TYPE
+// use the family name without it, and the exposition ends with "# EOF". In the classic
+// format, counter families are suffixed with _total as a whole when the options ask for it.
+func writeStores(w io.Writer, stores []*MetricsStore, options serverOptions, scrape bool) error {
+	names, families := gatherFamilies(stores, scrape)
+
+	output := bufio.NewWriter(w)
+	for _, name := range names {
+		series := families[name]
+
+		familyName, sampleName := name, name
+		if series[0].Type == MetricTypeCounter {
+			switch {
+			case options.format == ExpositionFormatOpenMetrics:
+				familyName = strings.TrimSuffix(name, "_total")
+				sampleName = familyName + "_total"
+			case options.appendTotalSuffix && !strings.HasSuffix(name, "_total"):
+				familyName = name + "_total"
+				sampleName = familyName
+			}
+		}
+
+		// Add HELP and TYPE comments once per family, before its samples
+		help := series[0].help
+		if help == "" {
+			help = DefaultMetricHelp
+		}
+		if options.format == ExpositionFormatOpenMetrics {
+			// OpenMetrics escapes HELP text like label values, double quotes included
+			help = escapeLabelValue(help)
+		} else {
+			help = helpReplacer.Replace(help)
+		}
+		writeStrings(output, "# HELP ", familyName, " ", help, "\n")
+		writeStrings(output, "# TYPE ", familyName, " ", series[0].Type, "\n")
+
+		for _, metric := range series {
+			switch metric.Type {
+			case MetricTypeHistogram:
+				writeHistogram(output, metric)
+				continue
+			case MetricTypeSummary:
+				writeSummary(output, metric)
+				continue
+			}
+
+			writeSample(output, sampleName, "", metric.Labels, formatValue(metric.Value))
+		}
+	}
+
+	if options.format == ExpositionFormatOpenMetrics {
+		_, _ = output.WriteString("# EOF\n")
+	}
+	return output.Flush()
+}
+
+// writeStrings writes each string in turn. Write errors are reported by the final Flush.
+func writeStrings(output *bufio.Writer, values ...string) {
+	for _, value := range values {
+		_, _ = output.WriteString(value)
+	}
+}
+
+// renderJSON renders the union of the metrics held by several stores as a JSON array,
+// ordered by metric name and then labels so consecutive snapshots diff cleanly.
+// Gauges holding NaN or an infinity are left out, as JSON numbers cannot represent them.
+func renderJSON(stores []*MetricsStore) ([]byte, error) {
+	names, families := gatherFamilies(stores, false)
+
+	metrics := make([]*Metric, 0, len(names))
+	for _, name := range names {
+		for _, metric := range families[name] {
+			if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+				continue
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	return json.Marshal(metrics)
+}
+
+// gatherFamilies snapshots the stores and groups their series by metric name.
+// It returns the sorted family names alongside the series of each family, sorted by labels.
+// Gauge aggregation windows are closed for scrapes only.
+func gatherFamilies(stores []*MetricsStore, scrape bool) ([]string, map[string][]*Metric) {
+	// Group series by metric name so each family is emitted contiguously
+	families := make(map[string][]*Metric)
+	for _, store := range stores {
+		for _, metric := range store.snapshot(scrape) {
+			families[metric.Name] = append(families[metric.Name], metric)
+		}
+	}
+
+	for name, series := range families {
+		// Instances sharing a server may produce the same series, which must be emitted only once
+		if len(stores) > 1 {
+			series = mergeSeries(series)
+		}
+
+		// Order series by their labels so the output is stable across scrapes
+		keys := make(map[*Metric]string, len(series))
+		for _, metric := range series {
+			keys[metric] = labelsKey(metric.Labels)
+		}
+		sort.Slice(series, func(i, j int) bool {
+			return keys[series[i]] < keys[series[j]]
+		})
+
+		families[name] = series
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, families
+}
+
+// mergeSeries combines snapshots of one family that have identical labels into a single series.
+// Counters and histograms are summed, summaries pool their samples and gauges keep the most
+// recently updated value. Snapshots are combined in place.
+func mergeSeries(series []*Metric) []*Metric {
+	merged := make([]*Metric, 0, len(series))
+	byLabels := make(map[string]int, len(series))
+
+	for _, metric := range series {
+		key := labelsKey(metric.Labels)
+		index, ok := byLabels[key]
+		if !ok {
+			byLabels[key] = len(merged)
+			merged = append(merged, metric)
+			continue
+		}
+
+		combined := merged[index]
+		switch combined.Type {
+		case MetricTypeCounter:
+			combined.Value += metric.Value
+		case MetricTypeGauge:
+			if metric.LastUpdated.After(combined.LastUpdated) {
+				combined.Value = metric.Value
+				combined.LastUpdated = metric.LastUpdated
+			}
+		case MetricTypeHistogram:
+			if !sameBuckets(combined.Buckets, metric.Buckets) {
+				// Bucket layouts cannot be combined, keep the first series
+				continue
+			}
+			for i := range combined.BucketCounts {
+				combined.BucketCounts[i] += metric.BucketCounts[i]
+			}
+			combined.Sum += metric.Sum
+			combined.Count += metric.Count
+		case MetricTypeSummary:
+			combined.summary = combined.summary.merge(metric.summary)
+			combined.Sum += metric.Sum
+			combined.Count += metric.Count
+		}
+
+	}
+	return merged
+}
+
+// sameBuckets reports whether two histograms use the same bucket upper bounds.
+func sameBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// labelsKey returns a string uniquely identifying a label set.
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// writeHistogram writes the _bucket, _sum and _count series of a histogram metric.
+func writeHistogram(output *bufio.Writer, metric *Metric) {
+	for i, upperBound := range metric.Buckets {
+		le := strconv.FormatFloat(upperBound, 'g', -1, 64)
+		writeSample(output, metric.Name, "_bucket", metric.Labels, strconv.FormatUint(metric.BucketCounts[i], 10), "le", le)
+	}
+	count := strconv.FormatUint(metric.Count, 10)
+	writeSample(output, metric.Name, "_bucket", metric.Labels, count, "le", "+Inf")
+	writeSample(output, metric.Name, "_sum", metric.Labels, formatValue(metric.Sum))
+	writeSample(output, metric.Name, "_count", metric.Labels, count)
+}
+
+// writeSummary writes the quantile, _sum and _count series of a summary metric.
+func writeSummary(output *bufio.Writer, metric *Metric) {
+	for i, value := range metric.summary.query(metric.quantiles) {
+		quantile := strconv.FormatFloat(metric.quantiles[i], 'g', -1, 64)
+		writeSample(output, metric.Name, "", metric.Labels, formatValue(value), "quantile", quantile)
+	}
+	writeSample(output, metric.Name, "_sum", metric.Labels, formatValue(metric.Sum))
+	writeSample(output, metric.Name, "_count", metric.Labels, strconv.FormatUint(metric.Count, 10))
+}
+
+// writeSample writes a sample line made of the metric name and suffix, its labels and the formatted value.
+func writeSample(output *bufio.Writer, name, suffix string, labels map[string]string, value string, extra ...string) {
+	writeStrings(output, name, suffix)
+	writeLabels(output, labels, extra...)
+	writeStrings(output, " ", value, "\n")
+}
+
+// formatValue formats a sample value in its shortest exact representation, so fractions are never truncated.
+// Whole numbers that floats hold exactly are written without an exponent, e.g. 1000000 rather than 1e+06,
+// and non-finite values use the NaN, +Inf and -Inf tokens of the exposition formats.
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeLabels writes labels as a Prometheus label set sorted by name, appending any extra name/value pairs.
+func writeLabels(output *bufio.Writer, labels map[string]string, extra ...string) {
+	if len(labels) == 0 && len(extra) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	_ = output.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			_ = output.WriteByte(',')
+		}
+		writeStrings(output, k, `="`, escapeLabelValue(labels[k]), `"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if i > 0 || len(names) > 0 {
+			_ = output.WriteByte(',')
+		}
+		writeStrings(output, extra[i], `="`, escapeLabelValue(extra[i+1]), `"`)
+	}
+	_ = output.WriteByte('}')
+}
+
+// labelValueReplacer escapes backslashes, double quotes and newlines in label values.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpReplacer escapes backslashes and newlines in HELP text of the Prometheus text format.
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// escapeLabelValue escapes a label value per the Prometheus text exposition format.
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+// lookupNumericValue returns the first numeric value among headers, each resolved like its label.
+// Without one, it reports whether any of the headers had a value that could not be parsed.
+func (c *CustomMetrics) lookupNumericValue(headerNames []string, req *http.Request, responseHeaders http.Header) (value float64, ok, unparsable bool) {
+	for _, headerName := range headerNames {
+		headerValue := c.resolveHeader(headerName, req, responseHeaders).first()
+		if parsedValue, ok := c.parseNumericValue(headerValue); ok {
+			return parsedValue, true, false
+		}
+		unparsable = unparsable || headerValue != ""
+	}
+	return 0, false, unparsable
+}
+
+// resolvedHeader holds the values of a header and the side of the exchange they were read from.
+type resolvedHeader struct {
+	values []string
+	source string // HeaderSourceRequest or HeaderSourceResponse, empty when the header is missing
+}
+
+// first returns the first non-empty value of the header, or an empty string when it is missing.
+func (h resolvedHeader) first() string {
+	for _, value := range h.values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// resolveHeader reads a header from the request, or from the response when the request does not
+// have it, as allowed by HeaderSources. Labels and numeric values both resolve headers through it,
+// so a header present on both sides gives a metric its labels and value from the same side.
+func (c *CustomMetrics) resolveHeader(headerName string, req *http.Request, responseHeaders http.Header) resolvedHeader {
+	if c.readsRequest(headerName) {
+		if header := (resolvedHeader{values: req.Header.Values(headerName), source: HeaderSourceRequest}); header.first() != "" {
+			return header
+		}
+	}
+	if c.readsResponse(headerName) {
+		if header := (resolvedHeader{values: responseHeaders.Values(headerName), source: HeaderSourceResponse}); header.first() != "" {
+			return header
+		}
+	}
+	return resolvedHeader{}
+}
+
+// readsRequest reports whether a header is read from the request.
+func (c *CustomMetrics) readsRequest(headerName string) bool {
+	if len(c.headerSources) == 0 {
+		return true
+	}
+	return c.headerSources[http.CanonicalHeaderKey(headerName)] != HeaderSourceResponse
+}
+
+// readsResponse reports whether a header is read from the response.
+func (c *CustomMetrics) readsResponse(headerName string) bool {
+	if len(c.headerSources) == 0 {
+		return true
+	}
+	return c.headerSources[http.CanonicalHeaderKey(headerName)] != HeaderSourceRequest
+}
+
+// parseNumericValue parses a header value as a float, first narrowing it to the
+// capture group of the value regex when one is configured.
+func (c *CustomMetrics) parseNumericValue(headerValue string) (float64, bool) {
+	if headerValue == "" {
+		return 0, false
+	}
+
+	if c.valueRegex != nil {
+		match := c.valueRegex.FindStringSubmatch(headerValue)
+		if match == nil {
+			return 0, false
+		}
+		headerValue = match[1]
+	}
+
+	parsedValue, err := strconv.ParseFloat(headerValue, 64)
+	if err != nil {
+		return 0, false
+	}
+	return parsedValue, true
+}
+
+// counterIncrement returns the amount a counter is incremented by when counting header values.
+// Missing, unparsable, negative or infinite values fall back to the configured default so counters never decrease.
+func (c *CustomMetrics) counterIncrement(value float64, ok bool) float64 {
+	if !ok || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return c.counterDefaultIncrement
+	}
+	return value
+}
+
+// Snapshot returns copies of every series, including the metrics the plugin reports about
+// itself, for reading values without scraping. Counter names do not have the _total suffix.
+func (c *CustomMetrics) Snapshot() []Metric {
+	var metrics []*series
+	for i := range c.store.shards {
+		shard := &c.store.shards[i]
+		shard.mu.RLock()
+		for _, metric := range shard.metrics {
+			metrics = append(metrics, metric)
+		}
+		shard.mu.RUnlock()
+	}
+
+	c.store.internalMu.Lock()
+	for _, metric := range c.store.internal {
+		metrics = append(metrics, metric)
+	}
+	c.store.internalMu.Unlock()
+
+	snapshot := make([]Metric, len(metrics))
+	for i, metric := range metrics {
+		snapshot[i] = metric.export()
+	}
+	return snapshot
+}
+
+// GetMetric returns a copy of the series with the given name and exactly the given labels,
+// const labels included. Counter names do not have the _total suffix.
+func (c *CustomMetrics) GetMetric(name string, labels map[string]string) (Metric, bool) {
+	// Series are keyed without their const labels
+	keyLabels := make(map[string]string, len(labels))
+	for labelName, value := range labels {
+		if _, ok := c.constLabels[labelName]; !ok {
+			keyLabels[labelName] = value
+		}
+	}
+
+	metric := c.store.get(c.createMetricKey(name, keyLabels))
+	if metric == nil {
+		metric = c.store.internalMetric(name)
+	}
+	if metric == nil || !sameLabels(metric.Labels, labels) {
+		return Metric{}, false
+	}
+	return metric.export(), true
+}
+
+// sameLabels reports whether two label sets hold the same names and values.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for labelName, value := range a {
+		if other, ok := b[labelName]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// createMetricKey creates a unique key for a metric with labels.
+// Label names are sorted so the same label set always yields the same key, and the
+// metric name and each label name and value are prefixed with their length, so values
+// containing underscores or other separators cannot make two label sets collide.
+func (c *CustomMetrics) createMetricKey(metricName string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	size := binary.MaxVarintLen64 + len(metricName)
+	for k, v := range labels {
+		names = append(names, k)
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(names)
+
+	key := make([]byte, 0, size)
+	key = appendKeyPart(key, metricName)
+	for _, k := range names {
+		key = appendKeyPart(key, k)
+		key = appendKeyPart(key, labels[k])
+	}
+	return string(key)
+}
+
+// appendKeyPart appends a length-prefixed string to a series key.
+func appendKeyPart(key []byte, part string) []byte {
+	key = binary.AppendUvarint(key, uint64(len(part)))
+	return append(key, part...)
+}
+
+// invalidLabelChars matches runs of characters that are not allowed in Prometheus label names.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// validLabelName matches valid Prometheus label names.
+var validLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validHostName matches host names made of dot-separated letters, digits and hyphens.
+var validHostName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*\.?$`)
+
+// validMetricName matches valid Prometheus metric names.
+var validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// repeatedUnderscores matches runs of consecutive underscores.
+var repeatedUnderscores = regexp.MustCompile(`__+`)
+
+// labelSources returns the label headers, query parameters and cookies of the definitions an
+// option keyed by name applies to. Header names are case-insensitive, so they are matched canonically.
+func labelSources(definitions []MetricDefinition, name string) []string {
+	var sources []string
+	for _, definition := range definitions {
+		for _, headerName := range definition.Headers {
+			if http.CanonicalHeaderKey(headerName) == http.CanonicalHeaderKey(name) {
+				sources = append(sources, headerName)
+			}
+		}
+		for _, param := range definition.QueryParams {
+			if param == name {
+				sources = append(sources, param)
+			}
+		}
+		for _, cookie := range definition.Cookies {
+			if cookie == name {
+				sources = append(sources, cookie)
+			}
+		}
+	}
+	return sources
+}
+
+// sanitizePrometheusLabelName converts header names to valid Prometheus label names.
+// Prometheus label names must match [a-zA-Z_][a-zA-Z0-9_]*.
+func sanitizePrometheusLabelName(headerName string) string {
+	// Replace invalid characters with underscores, collapsing repeats
+	sanitized := invalidLabelChars.ReplaceAllString(headerName, "_")
+	sanitized = repeatedUnderscores.ReplaceAllString(sanitized, "_")
+
+	// Ensure it starts with a letter or underscore
+	if len(sanitized) > 0 && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+
+	// Convert to lowercase for consistency
+	return strings.ToLower(sanitized)
+}
+
+// requestLabels returns the labels derived from the request and response rather than headers.
+// Without a response, as when a request enters, the status labels are left out.
+func (c *CustomMetrics) requestLabels(req *http.Request, rw *responseWriter) map[string]string {
+	labels := make(map[string]string)
+	if c.statusCodeLabel && rw != nil {
+		labels["status"] = strconv.Itoa(rw.status())
+	}
+	if c.statusClassLabel && rw != nil {
+		labels["status_class"] = strconv.Itoa(rw.status()/100) + "xx"
+	}
+	if c.includeMethod {
+		labels["method"] = normalizeMethod(req.Method)
+	}
+	if c.includePath {
+		labels["path"] = c.resolvePath(req.URL.Path)
+	}
+	if c.includeHost {
+		labels["host"] = requestHost(req, c.trustForwardedHost)
+	}
+	if c.clientIPLabel {
+		labels["client_ip"] = clientIP(req.Header.Get("X-Forwarded-For"), req.RemoteAddr, c.anonymizeIP)
+	}
+	if len(c.labelTemplates) > 0 {
+		data := newTemplateData(req)
+		for _, labelTemplate := range c.labelTemplates {
+			labels[labelTemplate.name] = labelTemplate.render(data)
+		}
+	}
+	if c.includeRemoteIP {
+		var forwardedFor string
+		if c.trustXFF {
+			forwardedFor = req.Header.Get("X-Forwarded-For")
+		}
+		labels["remote_ip"] = maskedClientIP(forwardedFor, req.RemoteAddr, c.remoteIPMask, c.remoteIPv6Mask)
+	}
+	return labels
+}
+
+// otherMethodValue is the method label value for non-standard request methods.
+const otherMethodValue = "OTHER"
+
+// requestHost returns the lower-cased host a request was sent to, without its port. It is read
+// from the first X-Forwarded-Host when trusted, then from the request, then from its Host header.
+func requestHost(req *http.Request, trustForwarded bool) string {
+	var host string
+	if trustForwarded {
+		host, _, _ = strings.Cut(req.Header.Get("X-Forwarded-Host"), ",")
+		host = strings.TrimSpace(host)
+	}
+	if host == "" {
+		host = req.Host
+	}
+	if host == "" {
+		host = req.Header.Get("Host")
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		// Bracketed IPv6 addresses without a port
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	return strings.ToLower(host)
+}
+
+// normalizeMethod uppercases a request method and folds extension methods into
+// otherMethodValue, so the method label has at most ten values.
+func normalizeMethod(method string) string {
+	method = strings.ToUpper(method)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return otherMethodValue
+}
+
+// extractLabelValue narrows a header value to the first capture group of the header's extractor.
+// Values that do not match are replaced by the extractor default; headers without an extractor are kept as is.
+func (c *CustomMetrics) extractLabelValue(headerName, value string) string {
+	extractor := c.headerExtractors[headerName]
+	if extractor == nil {
+		return value
+	}
+
+	match := extractor.FindStringSubmatch(value)
+	if match == nil {
+		return c.headerExtractorDefault
+	}
+	return match[1]
+}
+
+// headerLabelValue returns the label value of a resolved header according to the multi-value
+// strategy, or an empty string when the header is missing.
+func (c *CustomMetrics) headerLabelValue(headerName string, header resolvedHeader) string {
+	values := header.values
+	switch c.multiValueStrategy {
+	case MultiValueJoin:
+		extracted := make([]string, 0, len(values))
+		for _, value := range values {
+			if value != "" {
+				extracted = append(extracted, c.labelValue(headerName, value))
+			}
+		}
+		return strings.Join(extracted, c.multiValueSeparator)
+	case MultiValueCount:
+		if len(values) > 0 {
+			return strconv.Itoa(len(values))
+		}
+		return ""
+	default:
+		if value := header.first(); value != "" {
+			return c.labelValue(headerName, value)
+		}
+		return ""
+	}
+}
+
+// labelValue turns one value of a header, query parameter or cookie into a label value, applying in
+// order the header's extractor, its transforms and its allowed values.
+func (c *CustomMetrics) labelValue(headerName, value string) string {
+	value = c.extractLabelValue(headerName, value)
+	value = c.transformLabelValue(headerName, value)
+	return c.allowedLabelValue(headerName, value)
+}
+
+// allowedLabelValue replaces a header's label value with the other value when the header has
+// allowed values that do not include it. Headers without allowed values are kept as is.
+func (c *CustomMetrics) allowedLabelValue(headerName, value string) string {
+	accepted, ok := c.allowedValues[headerName]
+	if !ok {
+		return value
+	}
+
+	key := value
+	if c.allowedCaseInsensitive {
+		key = strings.ToLower(value)
+	}
+	if allowed, ok := accepted[key]; ok {
+		return allowed
+	}
+	return c.allowedValuesOther
+}
+
+// queryLabelValue returns the label value of a query parameter, or an empty string when it is missing.
+func (c *CustomMetrics) queryLabelValue(query url.Values, param string) string {
+	if value := query.Get(param); value != "" {
+		return c.labelValue(param, value)
+	}
+	return ""
+}
+
+// cookieLabelValue returns the label value of a request cookie, or an empty string when it is missing.
+func (c *CustomMetrics) cookieLabelValue(req *http.Request, name string) string {
+	if value := cookieValue(req, name); value != "" {
+		return c.labelValue(name, value)
+	}
+	return ""
+}
+
+// cookieValue returns the value of a request cookie, or an empty string when it is missing.
+func cookieValue(req *http.Request, name string) string {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// collectMetrics collects every configured metric for a request.
+// The duration is the time spent in the downstream handler.
+func (c *CustomMetrics) collectMetrics(req *http.Request, rw *responseWriter, measured measurements) {
+	if !c.statusFilter.match(rw.status()) {
+		return
+	}
+
+	requestLabels := c.requestLabels(req, rw)
+	now := c.now()
+
+	// Parse the query string once for all metrics
+	var query url.Values
+	if c.useQuery {
+		query = req.URL.Query()
+	}
+
+	for _, definition := range c.definitions {
+		definition.Name = c.metricName(definition, req)
+		obs, ok := c.resolveObservation(definition, requestLabels, query, req, rw, measured, now)
+		if !ok {
+			continue
+		}
+		if c.collector != nil {
+			c.enqueue(obs)
+		} else {
+			c.applyObservation(obs)
+		}
+	}
+}
+
+// resolveObservation resolves what a request contributes to a single metric, using header values
+// as labels. It reports false when the request is not recorded for the metric.
+func (c *CustomMetrics) resolveObservation(definition MetricDefinition, requestLabels map[string]string, query url.Values, req *http.Request, rw *responseWriter, measured measurements, now time.Time) (observation, bool) {
+	responseHeaders := rw.Header()
+
+	// Collect header values as labels
+	labels := make(map[string]string, len(definition.Headers)+len(definition.QueryParams)+len(definition.Cookies)+len(requestLabels))
+	for labelName, value := range requestLabels {
+		labels[labelName] = value
+	}
+	var labelled bool // Whether any header, query parameter or cookie label has a value
+	for _, headerName := range definition.Headers {
+		// Header names are sanitized for Prometheus label compatibility in New
+		labelName := c.labelNames[headerName]
+
+		// Request headers win over response headers, as for numeric values
+		if value := c.headerLabelValue(headerName, c.resolveHeader(headerName, req, responseHeaders)); value != "" {
+			labels[labelName] = value
+			labelled = true
+		} else {
+			// Missing headers become empty labels unless they are omitted
+			c.setLabel(labels, labelName, "")
+		}
+	}
+
+	// Missing query parameters and cookies are handled like headers
+	for _, param := range definition.QueryParams {
+		value := c.queryLabelValue(query, param)
+		labelled = labelled || value != ""
+		c.setLabel(labels, c.labelNames[param], value)
+	}
+	for _, name := range definition.Cookies {
+		value := c.cookieLabelValue(req, name)
+		labelled = labelled || value != ""
+		c.setLabel(labels, c.labelNames[name], value)
+	}
+
+	// Metrics without label sources have nothing to require
+	sources := len(definition.Headers) + len(definition.QueryParams) + len(definition.Cookies)
+	if !labelled && sources > 0 && c.requireAnyLabel {
+		c.incrementInternal(unlabeledObservationsMetricName)
+		return observation{}, false
+	}
+
+	// Read the value from the dedicated value header if configured
+	valueHeaders := definition.Headers
+	if definition.ValueHeader != "" {
+		valueHeaders = []string{definition.ValueHeader}
+	}
+
+	// Values that cannot be parsed fall back like missing ones, and are counted as dropped samples
+	var numeric float64
+	var numericOK, unparsable bool
+	if c.valueBuckets != nil || definition.Type != MetricTypeCounter || c.counterValueFromHeader {
+		numeric, numericOK, unparsable = c.lookupNumericValue(valueHeaders, req, responseHeaders)
+	}
+	if c.valueBuckets != nil {
+		labels[c.bucketLabelName] = c.valueBuckets.classify(numeric, numericOK)
+	}
+
+	// Create a unique metric key based on labels
+	c.dropConstLabelNames(labels)
+	metricKey := c.createMetricKey(definition.Name, labels)
+
+	// Resolve the value before taking any lock
+	var value float64
+	update := true
+	switch definition.Type {
+	case MetricTypeCounter:
+		value = 1 // Count every request
+		if c.counterValueFromHeader {
+			value = c.counterIncrement(numeric, numericOK)
+		} else {
+			unparsable = false // The value headers only classify the observation
+		}
+		value *= c.counterScale
+	case MetricTypeHistogram, MetricTypeSummary:
+		value = c.defaultValue
+		if numericOK {
+			value = numeric
+		}
+	case MetricTypeGauge:
+		value = numeric
+		if !numericOK {
+			// Keep the last known value rather than reporting the default, which is
+			// meaningless as a delta or extreme
+			update = !c.gaugeSkipMissing && c.gaugeMode == GaugeModeSet
+			value = c.defaultValue
+		}
+	}
+
+	// Gauges set to NaN or an infinity expose them as such, but they would stick in the totals of
+	// counters, histograms and summaries and in the sums and extremes of the other gauge modes, so
+	// those observations are dropped and counted
+	var dropped bool
+	if update && (math.IsNaN(value) || math.IsInf(value, 0)) && (definition.Type != MetricTypeGauge || c.gaugeMode != GaugeModeSet) {
+		dropped = true
+		update = false
+	}
+
+	return observation{
+		definition: definition,
+		key:        metricKey,
+		labels:     labels,
+		value:      value,
+		update:     update,
+		dropped:    dropped || unparsable,
+		measured:   measured,
+		now:        now,
+	}, true
+}
+
+// applyObservation records an observation in the store and pushes it to StatsD.
+func (c *CustomMetrics) applyObservation(obs observation) {
+	definition, labels, value, measured, now := obs.definition, obs.labels, obs.value, obs.measured, obs.now
+	if obs.dropped {
+		c.countDroppedSample()
+	}
+
+	if obs.update {
+		// Get or create metric with labels, then update it; only non-counters need its lock
+		metric := c.getSeries(obs.key, definition, c.histogramBuckets, labels)
+		switch definition.Type {
+		case MetricTypeCounter:
+			metric.addCounter(value)
+		case MetricTypeHistogram, MetricTypeSummary:
+			metric.mu.Lock()
+			metric.observe(value)
+			metric.mu.Unlock()
+		case MetricTypeGauge:
+			metric.mu.Lock()
+			metric.updateGauge(value, c.gaugeMode, c.gaugeAggregation)
+			if c.gaugeMode != GaugeModeSet {
+				// StatsD gauges are set to the resulting value rather than the delta or candidate extreme
+				value = metric.Value
+			}
+			metric.mu.Unlock()
+		}
+		metric.touch(now)
+
+		switch definition.Type {
+		case MetricTypeCounter:
+			c.pushStatsD(definition.Name, value, statsdCounter, labels)
+		case MetricTypeHistogram, MetricTypeSummary:
+			c.pushStatsD(definition.Name, value, statsdTiming, labels)
+		case MetricTypeGauge:
+			c.pushStatsD(definition.Name, value, statsdGauge, labels)
+		}
+	}
+
+	if c.measureDuration {
+		c.observeHistogram(definition.Name+"_duration_seconds", labels, c.durationBuckets, measured.duration.Seconds(), now)
+		c.pushStatsD(definition.Name+"_duration", float64(measured.duration)/float64(time.Millisecond), statsdTiming, labels)
+	}
+
+	if c.requestSizeMetric {
+		c.observeHistogram(definition.Name+"_request_bytes", labels, c.sizeBuckets, float64(measured.requestBytes), now)
+		c.pushStatsD(definition.Name+"_request_bytes", float64(measured.requestBytes), statsdHistogram, labels)
+	}
+
+	if c.responseSizeMetric {
+		// Handlers that never write count as empty responses
+		c.observeHistogram(definition.Name+"_response_bytes", labels, c.sizeBuckets, float64(measured.responseBytes), now)
+		c.pushStatsD(definition.Name+"_response_bytes", float64(measured.responseBytes), statsdHistogram, labels)
+	}
+
+	if c.measureSize {
+		c.addToCounter(definition.Name+"_request_bytes_total", labels, float64(measured.requestBytes)*c.counterScale, now)
+		c.addToCounter(definition.Name+"_response_bytes_total", labels, float64(measured.responseBytes)*c.counterScale, now)
+	}
+}
+
+// setLabel adds a label, leaving out empty values when OmitEmptyLabels is set.
+func (c *CustomMetrics) setLabel(labels map[string]string, name, value string) {
+	if value == "" && c.omitEmptyLabels {
+		return
+	}
+	labels[name] = value
+}
+
+// enterInFlight increments the in-flight gauge of every metric and returns the function that
+// decrements them again. Labels are captured from the request on entry, so response headers
+// and the status code are not part of them.
+func (c *CustomMetrics) enterInFlight(req *http.Request) func() {
+	requestLabels := c.requestLabels(req, nil)
+
+	var query url.Values
+	if c.useQuery {
+		query = req.URL.Query()
+	}
+
+	now := c.now()
+	gauges := make([]*series, 0, len(c.definitions))
+	for _, definition := range c.definitions {
+		definition.Name = c.metricName(definition, req)
+		labels := make(map[string]string, len(definition.Headers)+len(definition.QueryParams)+len(definition.Cookies)+len(requestLabels))
+		for labelName, value := range requestLabels {
+			labels[labelName] = value
+		}
+		for _, headerName := range definition.Headers {
+			// Requests in flight have no response headers yet
+			if value := c.headerLabelValue(headerName, c.resolveHeader(headerName, req, nil)); value != "" {
+				labels[c.labelNames[headerName]] = value
+			} else {
+				c.setLabel(labels, c.labelNames[headerName], "")
+			}
+		}
+		for _, param := range definition.QueryParams {
+			c.setLabel(labels, c.labelNames[param], c.queryLabelValue(query, param))
+		}
+		for _, name := range definition.Cookies {
+			c.setLabel(labels, c.labelNames[name], c.cookieLabelValue(req, name))
+		}
+
+		c.dropConstLabelNames(labels)
+		gaugeDefinition := MetricDefinition{
+			Name: definition.Name + "_in_flight",
+			Type: MetricTypeGauge,
+		}
+		gauge := c.getSeries(c.createMetricKey(gaugeDefinition.Name, labels), gaugeDefinition, nil, labels)
+		gauge.mu.Lock()
+		gauge.inFlight = true
+		gauge.Value++
+		gauge.mu.Unlock()
+		gauge.touch(now)
+		gauges = append(gauges, gauge)
+	}
+
+	return func() {
+		now := c.now()
+		for _, gauge := range gauges {
+			gauge.mu.Lock()
+			gauge.Value--
+			gauge.mu.Unlock()
+			gauge.touch(now)
+		}
+	}
+}
+
+// addToCounter adds a value to the counter series with the given name and labels.
+func (c *CustomMetrics) addToCounter(name string, labels map[string]string, value float64, now time.Time) {
+	definition := MetricDefinition{
+		Name: name,
+		Type: MetricTypeCounter,
+	}
+	metric := c.getSeries(c.createMetricKey(name, labels), definition, nil, labels)
+	metric.addCounter(value)
+	metric.touch(now)
+	c.pushStatsD(name, value, statsdCounter, labels)
+}
+
+// observeHistogram records a value in a histogram derived from a configured metric.
+func (c *CustomMetrics) observeHistogram(name string, labels map[string]string, buckets []float64, value float64, now time.Time) {
+	definition := MetricDefinition{
+		Name: name,
+		Type: MetricTypeHistogram,
+	}
+	metric := c.getSeries(c.createMetricKey(name, labels), definition, buckets, labels)
+	metric.mu.Lock()
+	metric.observe(value)
+	metric.mu.Unlock()
+	metric.touch(now)
+}
+
+// getSeries returns the series stored under a key, creating it if needed.
+// Existing series are found under the read lock of their shard; the write lock is only taken to create one.
+func (c *CustomMetrics) getSeries(key string, definition MetricDefinition, buckets []float64, labels map[string]string) *series {
+	shard := c.store.shard(key)
+	shard.mu.RLock()
+	metric := shard.metrics[key]
+	shard.mu.RUnlock()
+	if metric != nil {
+		return metric
+	}
+
+	shard.mu.Lock()
+
+	// Another request may have created the series in the meantime
+	if metric := shard.metrics[key]; metric != nil {
+		shard.mu.Unlock()
+		return metric
+	}
+
+	// Reserve a slot under the series limit, which is shared by all shards
+	if series := atomic.AddInt64(&c.store.series, 1); c.maxSeries > 0 && series > int64(c.maxSeries) {
+		atomic.AddInt64(&c.store.series, -1)
+		shard.mu.Unlock()
+
+		// Fold new label combinations into the overflow series once the limit is reached
+		return c.overflowMetric(definition, buckets, labels)
+	}
+
+	metric = c.newMetric(definition, buckets, labels)
+	shard.metrics[key] = metric
+	shard.mu.Unlock()
+	return metric
+}
+
+// newMetric creates a series for a metric definition with the given labels.
+// Histograms use the given bucket upper bounds.
+func (c *CustomMetrics) newMetric(definition MetricDefinition, buckets []float64, labels map[string]string) *series {
+	metric := &series{Metric: Metric{
+		Name:      definition.Name,
+		Type:      definition.Type,
+		Value:     0,
+		Labels:    c.withConstLabels(labels),
+		help:      definition.Help,
+		startedAt: c.now(),
+	}}
+	switch definition.Type {
+	case MetricTypeHistogram:
+		metric.Buckets = buckets
+		metric.BucketCounts = make([]uint64, len(buckets))
+	case MetricTypeSummary:
+		if c.summaryMaxAge > 0 {
+			metric.summary = newWindowedQuantileEstimator(c.summaryMaxSamples, c.summaryMaxAge, c.now)
+		} else {
+			metric.summary = newQuantileEstimator(c.summaryMaxSamples)
+		}
+		metric.quantiles = c.quantiles
+	}
+	return metric
+}
+
+// dropConstLabelNames deletes the labels derived from a request that share their name with a
+// const label, which takes precedence. Series are keyed without const labels, so requests only
+// differing by an overridden label must share a series.
+func (c *CustomMetrics) dropConstLabelNames(labels map[string]string) {
+	for labelName := range c.constLabels {
+		delete(labels, labelName)
+	}
+}
+
+// withConstLabels returns the labels with the configured const labels added.
+// The given map is left untouched, as it may be shared by several series.
+func (c *CustomMetrics) withConstLabels(labels map[string]string) map[string]string {
+	if len(c.constLabels) == 0 {
+		return labels
+	}
+
+	merged := make(map[string]string, len(labels)+len(c.constLabels))
+	for labelName, value := range labels {
+		merged[labelName] = value
+	}
+	for labelName, value := range c.constLabels {
+		merged[labelName] = value
+	}
+	return merged
+}
+
+// overflowMetric returns the series that label combinations beyond the series limit are folded into.
+// It carries the same label names with every value replaced by overflowLabelValue, and each folded
+// observation is counted both as an overflow observation and as a dropped sample. Overflow series
+// do not count against the limit.
+func (c *CustomMetrics) overflowMetric(definition MetricDefinition, buckets []float64, labels map[string]string) *series {
+	c.incrementInternal(overflowObservationsMetricName)
+	c.countDroppedSample()
+
+	overflowLabels := make(map[string]string, len(labels))
+	for labelName := range labels {
+		overflowLabels[labelName] = overflowLabelValue
+	}
+
+	overflowKey := c.createMetricKey(definition.Name, overflowLabels)
+	shard := c.store.shard(overflowKey)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	metric := shard.metrics[overflowKey]
+	if metric == nil {
+		metric = c.newMetric(definition, buckets, overflowLabels)
+		metric.overflow = true
+		shard.metrics[overflowKey] = metric
+	}
+	return metric
+}
+
+// countDroppedSample records an observation that lost its value or labels: a value that was NaN,
+// infinite or not a number, or labels folded into an overflow series.
+func (c *CustomMetrics) countDroppedSample() {
+	c.incrementInternal(droppedSamplesMetricName)
+}
+
+// incrementInternal increments one of the counters the plugin reports about itself.
+func (c *CustomMetrics) incrementInternal(name string) {
+	c.store.incrementInternal(name, c.now())
+}
+
+// ready reports whether the instance has handled a request, or does not wait for one.
+func (c *CustomMetrics) ready() bool {
+	return c.readyWithoutTraffic || atomic.LoadInt32(&c.handled) == 1
+}
+
+// ServeHTTP processes HTTP requests and collects metrics based on both request and response headers.
+func (c *CustomMetrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&c.handled) == 0 {
+		atomic.StoreInt32(&c.handled, 1)
+	}
+
+	// Requests out of scope pass through untouched
+	if !c.measures(req) {
+		c.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if c.trackInFlight {
+		// Deferred so the gauges stay balanced even if the next handler panics
+		defer c.enterInFlight(req)()
+	}
+
+	// Requests left out of the sample skip collection entirely
+	if c.sampleRate < 1 && rand.Float64() >= c.sampleRate { //nolint:gosec // Sampling does not need a secure source.
+		c.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Wrap the response writer to capture response headers
+	wrappedRW := &responseWriter{ResponseWriter: rw}
+
+	// Bodies of unknown length are counted as the downstream handler reads them
+	var body *countingReader
+	if (c.measureSize || c.requestSizeMetric) && req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+		body = &countingReader{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	// Pass request to next handler with wrapped response writer, timing only the downstream call
+	start := time.Now()
 	c.next.ServeHTTP(wrappedRW, req)
+	measured := measurements{duration: time.Since(start), responseBytes: wrappedRW.bytesWritten}
+
+	if body != nil {
+		measured.requestBytes = body.bytesRead
+	} else if req.ContentLength > 0 {
+		measured.requestBytes = req.ContentLength
+	}
 
 	// Collect metrics based on configured headers from both request and response
-	c.collectMetrics(req, wrappedRW.Header())
+	c.collectMetrics(req, wrappedRW, measured)
 }
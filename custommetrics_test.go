@@ -2,10 +2,18 @@ package custommetrics
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMetricsOnly(t *testing.T) {
@@ -13,7 +21,7 @@ func TestMetricsOnly(t *testing.T) {
 	cfg.MetricHeaders = []string{"X-User-ID"}
 	cfg.MetricName = "test_counter"
 	cfg.MetricType = "counter"
-	cfg.MetricsPort = 8084
+	cfg.DisableServer = true
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -45,7 +53,7 @@ func TestMetrics(t *testing.T) {
 	cfg.MetricHeaders = []string{"X-User-ID", "X-Request-Size"}
 	cfg.MetricName = "test_counter"
 	cfg.MetricType = "counter"
-	cfg.MetricsPort = 8082
+	cfg.DisableServer = true
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -81,7 +89,7 @@ func TestCombinedRequestResponseHeaders(t *testing.T) {
 	cfg.MetricHeaders = []string{"X-User-ID", "X-Response-ID"}
 	cfg.MetricName = "combined_test_counter"
 	cfg.MetricType = "counter"
-	cfg.MetricsPort = 8083
+	cfg.DisableServer = true
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -130,9 +138,7 @@ func TestCombinedRequestResponseHeaders(t *testing.T) {
 	if !ok {
 		t.Fatal("handler is not a CustomMetrics instance")
 	}
-	plugin.store.mu.RLock()
-	metricsCount := len(plugin.store.metrics)
-	plugin.store.mu.RUnlock()
+	metricsCount := plugin.store.len()
 
 	if metricsCount == 0 {
 		t.Error("expected metrics to be created")
@@ -150,7 +156,7 @@ func TestLabelNameSanitization(t *testing.T) {
 	cfg.MetricHeaders = []string{"X-User-ID", "Content-Type", "123-Invalid"}
 	cfg.MetricName = "sanitization_test"
 	cfg.MetricType = "counter"
-	cfg.MetricsPort = 8086
+	cfg.DisableServer = true
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -193,34 +199,3397 @@ func TestLabelNameSanitization(t *testing.T) {
 	}
 }
 
+func TestSanitizePrometheusLabelName(t *testing.T) {
+	tests := map[string]string{
+		"X-User-ID":    "x_user_id",
+		"2fa-token":    "_2fa_token",
+		"content.type": "content_type",
+		"X--Double--":  "x_double_",
+		"a.-b":         "a_b",
+	}
+
+	for headerName, expected := range tests {
+		if sanitized := sanitizePrometheusLabelName(headerName); sanitized != expected {
+			t.Errorf("sanitizePrometheusLabelName(%q): expected %q, got %q", headerName, expected, sanitized)
+		}
+	}
+}
+
+func TestLabelValueEscaping(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: `foo"bar`, expected: `foo\"bar`},
+		{value: `a\b`, expected: `a\\b`},
+		{value: "line1\nline2", expected: `line1\nline2`},
+		{value: "plain", expected: "plain"},
+	}
+
+	for _, test := range tests {
+		if escaped := escapeLabelValue(test.value); escaped != test.expected {
+			t.Errorf("escapeLabelValue(%q): expected %q, got %q", test.value, test.expected, escaped)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"User-Agent"}
+	cfg.MetricName = "escaping_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "escaping-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "agent \"quoted\" \\ multi\nline")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	expected := `escaping_test_total{user_agent="agent \"quoted\" \\ multi\nline"} 1` + "\n"
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
+
+func TestHelpAndTypePerMetricFamily(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "family_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "family-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Register two series for each of two different metric families
+	a1 := &series{Metric: Metric{Name: "family_a", Type: MetricTypeCounter, Labels: map[string]string{"x": "1"}}}
+	a1.addCounter(1)
+	a2 := &series{Metric: Metric{Name: "family_a", Type: MetricTypeCounter, Labels: map[string]string{"x": "2"}}}
+	a2.addCounter(3)
+	plugin.store.put("a1", a1)
+	plugin.store.put("b1", &series{Metric: Metric{Name: "family_b", Type: MetricTypeGauge, Value: 2, Labels: map[string]string{"x": "1"}}})
+	plugin.store.put("a2", a2)
+	plugin.store.put("b2", &series{Metric: Metric{Name: "family_b", Type: MetricTypeGauge, Value: 4, Labels: map[string]string{"x": "2"}}})
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	if count := strings.Count(output, "# HELP "); count != 2 {
+		t.Errorf("expected 2 HELP lines, got %d", count)
+	}
+	if count := strings.Count(output, "# TYPE "); count != 2 {
+		t.Errorf("expected 2 TYPE lines, got %d", count)
+	}
+
+	// Every sample must directly follow the HELP/TYPE block of its own family
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 lines, got %d", len(lines))
+	}
+	for _, block := range [][]string{lines[:4], lines[4:]} {
+		name := strings.Fields(block[0])[2]
+		if block[0] != "# HELP "+name+" Custom metric based on HTTP headers" {
+			t.Errorf("unexpected HELP line %q", block[0])
+		}
+		if !strings.HasPrefix(block[1], "# TYPE "+name+" ") {
+			t.Errorf("expected TYPE line for %s, got %q", name, block[1])
+		}
+		for _, sample := range block[2:] {
+			if !strings.HasPrefix(sample, name+"{") {
+				t.Errorf("sample %q is not part of family %s", sample, name)
+			}
+		}
+	}
+}
+
+func TestHelpAndTypeOncePerName(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "once_per_name_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "once-per-name-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Add a second family whose series render over multiple lines
+	for _, user := range []string{"alice", "bob"} {
+		histogram := &series{Metric: Metric{
+			Name:         "once_per_name_histogram",
+			Type:         MetricTypeHistogram,
+			Labels:       map[string]string{"x_user_id": user},
+			Buckets:      []float64{1},
+			BucketCounts: []uint64{0},
+		}}
+		histogram.observe(0.5)
+		plugin.store.put("histogram_"+user, histogram)
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	for _, name := range []string{"once_per_name_test_total", "once_per_name_histogram"} {
+		if count := strings.Count(output, "# HELP "+name+" "); count != 1 {
+			t.Errorf("expected exactly 1 HELP line for %s, got %d", name, count)
+		}
+		if count := strings.Count(output, "# TYPE "+name+" "); count != 1 {
+			t.Errorf("expected exactly 1 TYPE line for %s, got %d", name, count)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Duration"}
+	cfg.MetricName = "histogram_test"
+	cfg.MetricType = "histogram"
+	cfg.DisableServer = true
+	cfg.HistogramBuckets = []float64{0.1, 0.5, 1}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "histogram-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"0.5", "0.5", "0.5"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Duration", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		"# TYPE histogram_test histogram\n",
+		`histogram_test_bucket{x_duration="0.5",le="0.1"} 0` + "\n",
+		`histogram_test_bucket{x_duration="0.5",le="0.5"} 3` + "\n",
+		`histogram_test_bucket{x_duration="0.5",le="1"} 3` + "\n",
+		`histogram_test_bucket{x_duration="0.5",le="+Inf"} 3` + "\n",
+		`histogram_test_sum{x_duration="0.5"} 1.5` + "\n",
+		`histogram_test_count{x_duration="0.5"} 3` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestHistogramBucketNormalization(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Duration"}
+	cfg.MetricName = "histogram_unsorted_test"
+	cfg.MetricType = "histogram"
+	cfg.DisableServer = true
+	cfg.HistogramBuckets = []float64{1, 0.1, 0.5}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "histogram-unsorted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value equal to a bucket boundary lands in that bucket
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Duration", "0.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := `histogram_unsorted_test_bucket{x_duration="0.1",le="0.1"} 1
+histogram_unsorted_test_bucket{x_duration="0.1",le="0.5"} 1
+histogram_unsorted_test_bucket{x_duration="0.1",le="1"} 1
+histogram_unsorted_test_bucket{x_duration="0.1",le="+Inf"} 1
+`
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected sorted buckets in output, got:\n%s", output)
+	}
+}
+
+func TestInvalidHistogramBuckets(t *testing.T) {
+	for _, buckets := range [][]float64{{0.1, 0.5, 0.1}, {math.NaN()}} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Duration"}
+		cfg.MetricType = "histogram"
+		cfg.DisableServer = true
+		cfg.HistogramBuckets = buckets
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-buckets"); err == nil {
+			t.Errorf("expected error for buckets %v", buckets)
+		}
+	}
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Duration"}
+	cfg.MetricName = "summary_test"
+	cfg.MetricType = "summary"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "summary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Duration", "2")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		"# TYPE summary_test summary\n",
+		`summary_test{x_duration="2",quantile="0.5"} 2` + "\n",
+		`summary_test{x_duration="2",quantile="0.9"} 2` + "\n",
+		`summary_test{x_duration="2",quantile="0.99"} 2` + "\n",
+		`summary_test_sum{x_duration="2"} 8` + "\n",
+		`summary_test_count{x_duration="2"} 4` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestInvalidQuantiles(t *testing.T) {
+	for _, q := range []float64{-0.1, 1.5} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Duration"}
+		cfg.MetricType = "summary"
+		cfg.DisableServer = true
+		cfg.Quantiles = []float64{0.5, q}
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-quantiles"); err == nil {
+			t.Errorf("expected error for quantile %v", q)
+		}
+	}
+}
+
+func TestMultipleMetricDefinitions(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "multi_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+		{Name: "multi_queue_depth", Type: "gauge", Headers: []string{"X-Queue-Depth"}},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Queue-Depth", "7")
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "multi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		"# TYPE multi_requests_total counter\n",
+		`multi_requests_total{x_user_id="user123"} 2` + "\n",
+		"# TYPE multi_queue_depth gauge\n",
+		`multi_queue_depth{x_queue_depth="7"} 7` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestMetricDefinitionValueHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.HistogramBuckets = []float64{0.1, 1}
+	cfg.Metrics = []MetricDefinition{
+		{Name: "value_header_requests", Type: "counter", Headers: []string{"X-Tenant"}},
+		{Name: "value_header_duration", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Duration"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "value-header-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, duration := range []string{"0.05", "0.5"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Duration", duration)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		`value_header_requests_total{x_tenant="acme"} 2` + "\n",
+		`value_header_duration_bucket{x_tenant="acme",le="0.1"} 1` + "\n",
+		`value_header_duration_bucket{x_tenant="acme",le="1"} 2` + "\n",
+		`value_header_duration_sum{x_tenant="acme"} 0.55` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestInvalidMetricDefinitions(t *testing.T) {
+	tests := map[string][]MetricDefinition{
+		"missing headers": {{Name: "no_headers", Type: "counter"}},
+		"missing name":    {{Type: "counter", Headers: []string{"X-User-ID"}}},
+		"missing type":    {{Name: "no_type", Headers: []string{"X-User-ID"}}},
+		"unknown type":    {{Name: "typo", Type: "couter", Headers: []string{"X-User-ID"}}},
+		"empty":           {{}},
+		"duplicate name": {
+			{Name: "dup", Type: "counter", Headers: []string{"X-User-ID"}},
+			{Name: "dup", Type: "gauge", Headers: []string{"X-Queue-Depth"}},
+		},
+	}
+
+	for name, definitions := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		cfg.Metrics = definitions
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-definitions-test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMetricTypeValidation(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	for _, metricType := range []string{MetricTypeCounter, MetricTypeHistogram, MetricTypeGauge, MetricTypeSummary} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricType = metricType
+		cfg.DisableServer = true
+
+		handler, err := New(context.Background(), next, cfg, "valid-type-test")
+		if err != nil {
+			t.Errorf("expected type %q to be accepted, got %v", metricType, err)
+			continue
+		}
+		_ = handler.(*CustomMetrics).Stop()
+	}
+
+	// A typo is reported with the valid types instead of yielding a series that never changes
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricType = "couter"
+	cfg.DisableServer = true
+
+	_, err := New(context.Background(), next, cfg, "invalid-type-test")
+	if err == nil {
+		t.Fatal("expected error for an unknown metric type")
+	}
+	for _, want := range []string{`"couter"`, `"counter"`, `"histogram"`, `"gauge"`, `"summary"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %q", want, err)
+		}
+	}
+
+	cfg = CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = ""
+	cfg.DisableServer = true
+
+	if _, err := New(context.Background(), next, cfg, "empty-name-test"); err == nil {
+		t.Error("expected error for an empty metric name")
+	}
+}
+
+func TestStatusCodeLabel(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "status_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.StatusCodeLabel = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/write":
+			_, _ = rw.Write([]byte("ok"))
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		case "/error":
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	handler, err := New(ctx, next, cfg, "status-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/write", "/missing", "/error", "/error", "/empty"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := map[string]string{
+		"200": " 2\n",
+		"404": " 1\n",
+		"500": " 2\n",
+	}
+	for status, suffix := range expected {
+		found := false
+		for _, line := range strings.Split(output, "\n") {
+			if strings.Contains(line, `status="`+status+`"`) {
+				found = true
+				if !strings.HasSuffix(line+"\n", suffix) {
+					t.Errorf("unexpected value for status %s: %q", status, line)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("expected a series for status %s", status)
+		}
+	}
+}
+
+func TestStatusClassLabel(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		code, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+		if err != nil {
+			t.Errorf("unexpected path %s", req.URL.Path)
+			return
+		}
+		rw.WriteHeader(code)
+	})
+	codes := []string{"204", "301", "404", "503", "503"}
+
+	t.Run("alone", func(t *testing.T) {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricName = "status_class_test"
+		cfg.DisableServer = true
+		cfg.StatusClassLabel = true
+
+		handler, err := New(context.Background(), next, cfg, "status-class-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, code := range codes {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/"+code, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-User-ID", "user123")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		output := handler.(*CustomMetrics).renderPrometheusFormat()
+		for _, line := range []string{
+			`status_class_test_total{status_class="2xx",x_user_id="user123"} 1`,
+			`status_class_test_total{status_class="3xx",x_user_id="user123"} 1`,
+			`status_class_test_total{status_class="4xx",x_user_id="user123"} 1`,
+			`status_class_test_total{status_class="5xx",x_user_id="user123"} 2`,
+		} {
+			if !strings.Contains(output, line+"\n") {
+				t.Errorf("expected output to contain %q, got:\n%s", line, output)
+			}
+		}
+		if strings.Contains(output, `status="`) {
+			t.Errorf("expected no exact status label, got:\n%s", output)
+		}
+	})
+
+	t.Run("with status code", func(t *testing.T) {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricName = "status_class_code_test"
+		cfg.DisableServer = true
+		cfg.StatusCodeLabel = true
+		cfg.StatusClassLabel = true
+
+		handler, err := New(context.Background(), next, cfg, "status-class-code-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, code := range codes {
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/"+code, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-User-ID", "user123")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		output := handler.(*CustomMetrics).renderPrometheusFormat()
+		for _, line := range []string{
+			`status_class_code_test_total{status="204",status_class="2xx",x_user_id="user123"} 1`,
+			`status_class_code_test_total{status="301",status_class="3xx",x_user_id="user123"} 1`,
+			`status_class_code_test_total{status="404",status_class="4xx",x_user_id="user123"} 1`,
+			`status_class_code_test_total{status="503",status_class="5xx",x_user_id="user123"} 2`,
+		} {
+			if !strings.Contains(output, line+"\n") {
+				t.Errorf("expected output to contain %q, got:\n%s", line, output)
+			}
+		}
+	})
+}
+
+func TestMethodAndPathLabels(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "method_path_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.IncludeMethod = true
+	cfg.IncludePath = true
+	cfg.PathTemplates = []string{"/users/me", "/users/{id}"}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "method-path-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodGet, path: "/users/123"},
+		{method: http.MethodGet, path: "/users/456"},
+		{method: http.MethodPost, path: "/users/me"},
+		{method: http.MethodGet, path: "/unknown/path"},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequestWithContext(ctx, r.method, "http://localhost"+r.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := map[string]string{
+		`method="GET"`:  `path="/users/{id}"`,
+		`method="POST"`: `path="/users/me"`,
+	}
+	for method, path := range expected {
+		found := false
+		for _, line := range strings.Split(output, "\n") {
+			if strings.Contains(line, method) && strings.Contains(line, path) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a series with %s and %s", method, path)
+		}
+	}
+	if !strings.Contains(output, `path="other"`) {
+		t.Error("expected unmatched path to fall back to other")
+	}
+	if strings.Contains(output, "/users/123") {
+		t.Error("expected raw path to be collapsed to its template")
+	}
+}
+
+func TestCounterValueFromHeader(t *testing.T) {
+	tests := []struct {
+		defaultIncrement float64
+		expected         string
+	}{
+		{defaultIncrement: 0, expected: `counter_value_test_total{x_tenant="acme"} 350`},
+		{defaultIncrement: 1, expected: `counter_value_test_total{x_tenant="acme"} 353`},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		cfg.CounterValueFromHeader = true
+		cfg.CounterDefaultIncrement = test.defaultIncrement
+		cfg.Metrics = []MetricDefinition{
+			{Name: "counter_value_test", Type: "counter", Headers: []string{"X-Tenant"}, ValueHeader: "X-Billed-Bytes"},
+		}
+
+		ctx := context.Background()
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})
+
+		handler, err := New(ctx, next, cfg, "counter-value-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, value := range []string{"100", "250", "-5", "abc", ""} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Tenant", "acme")
+			req.Header.Set("X-Billed-Bytes", value)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+
+		output := plugin.renderPrometheusFormat()
+		if !strings.Contains(output, test.expected+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", test.expected, output)
+		}
+	}
+}
+
+func TestMaxSeriesOverflow(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Request-ID"}
+	cfg.MetricName = "max_series_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.MaxSeries = 2
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "max-series-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c", "d", "e", "a"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", id)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	seriesCount := plugin.store.len()
+	if seriesCount != 3 {
+		t.Errorf("expected 2 series plus the overflow series, got %d", seriesCount)
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		`max_series_test_total{x_request_id="a"} 2` + "\n",
+		`max_series_test_total{x_request_id="b"} 1` + "\n",
+		`max_series_test_total{x_request_id="__overflow__"} 3` + "\n",
+		"# TYPE custommetrics_overflow_observations_total counter\n",
+		`custommetrics_overflow_observations_total{plugin="max-series-test"} 3` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestMeasureDuration(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "duration_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.MeasureDuration = true
+	cfg.DurationBuckets = []float64{0.01, 10}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "duration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		`duration_test_total{x_user_id="user123"} 1` + "\n",
+		"# TYPE duration_test_duration_seconds histogram\n",
+		`duration_test_duration_seconds_bucket{x_user_id="user123",le="0.01"} 0` + "\n",
+		`duration_test_duration_seconds_bucket{x_user_id="user123",le="10"} 1` + "\n",
+		`duration_test_duration_seconds_bucket{x_user_id="user123",le="+Inf"} 1` + "\n",
+		`duration_test_duration_seconds_count{x_user_id="user123"} 1` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+}
+
+func TestMaxSeriesUnderConcurrency(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Request-ID"}
+	cfg.MetricName = "max_series_concurrency_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.MaxSeries = 50
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "max-series-concurrency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				req.Header.Set("X-Request-ID", fmt.Sprintf("%d-%d", worker, i))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	seriesCount := plugin.store.len()
+	overflow, ok := plugin.GetMetric(overflowObservationsMetricName, map[string]string{"plugin": "max-series-concurrency-test"})
+	if !ok {
+		t.Fatal("expected the overflow observations metric")
+	}
+	folded := overflow.Value
+
+	if seriesCount != cfg.MaxSeries+1 {
+		t.Errorf("expected %d series, got %d", cfg.MaxSeries+1, seriesCount)
+	}
+	if folded != 800-50 {
+		t.Errorf("expected %d folded observations, got %v", 800-50, folded)
+	}
+}
+
+func TestOpenMetricsFormat(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.ExpositionFormat = "openmetrics"
+	cfg.Metrics = []MetricDefinition{
+		{Name: "openmetrics_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+		{Name: "openmetrics_bytes_total", Type: "counter", Headers: []string{"X-User-ID"}},
+		{Name: "openmetrics_queue_depth", Type: "gauge", Headers: []string{"X-User-ID"}, ValueHeader: "X-Queue-Depth"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "openmetrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	req.Header.Set("X-Queue-Depth", "3")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderOpenMetricsFormat()
+	t.Logf("OpenMetrics output:\n%s", output)
+
+	expected := []string{
+		"# TYPE openmetrics_requests counter\n",
+		`openmetrics_requests_total{x_user_id="user123"} 1` + "\n",
+		"# TYPE openmetrics_bytes counter\n",
+		`openmetrics_bytes_total{x_user_id="user123"} 1` + "\n",
+		"# TYPE openmetrics_queue_depth gauge\n",
+		`openmetrics_queue_depth{x_user_id="user123"} 3` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected output to contain %q", line)
+		}
+	}
+	if strings.Contains(output, "openmetrics_queue_depth_total") {
+		t.Error("expected gauges not to get the _total suffix")
+	}
+	if !strings.HasSuffix(output, "\n# EOF\n") {
+		t.Error("expected output to end with # EOF")
+	}
+}
+
+func TestInvalidExpositionFormat(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.ExpositionFormat = "json"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	if _, err := New(context.Background(), next, cfg, "invalid-format-test"); err == nil {
+		t.Error("expected error for an unknown exposition format")
+	}
+}
+
 func BenchmarkCustomMetrics(b *testing.B) {
 	cfg := CreateConfig()
 	cfg.MetricHeaders = []string{"X-User-ID"}
-	cfg.MetricName = "benchmark_counter"
-	cfg.MetricType = "counter"
-	cfg.MetricsPort = 0 // Use random available port
+	cfg.MetricName = "benchmark_counter"
+	cfg.MetricType = "counter"
+	cfg.MetricsPort = 0 // Use random available port
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "benchmark-plugin")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Run at least 8 goroutines per CPU to surface lock contention
+	b.SetParallelism(8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			// Create a new request for each iteration
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			req.Header.Set("X-User-ID", "user123")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+		}
+	})
+	b.StopTimer()
+
+	// Smoke check that the collected series are served on the randomly chosen port
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		b.Fatal("handler is not a CustomMetrics instance")
+	}
+	b.Cleanup(func() { _ = plugin.Stop() })
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort()), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `benchmark_counter_total{x_user_id="user123"}`) {
+		b.Errorf("expected the scrape to return the benchmarked series, got status %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "zeta_requests", Type: "counter", Headers: []string{"X-User-ID", "X-Region"}},
+		{Name: "alpha_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "deterministic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	for _, user := range []string{"carol", "alice", "bob"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		req.Header.Set("X-Region", "eu")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := "# HELP alpha_requests_total Custom metric based on HTTP headers\n" +
+		"# TYPE alpha_requests_total counter\n" +
+		`alpha_requests_total{x_user_id="alice"} 1` + "\n" +
+		`alpha_requests_total{x_user_id="bob"} 1` + "\n" +
+		`alpha_requests_total{x_user_id="carol"} 1` + "\n" +
+		"# HELP zeta_requests_total Custom metric based on HTTP headers\n" +
+		"# TYPE zeta_requests_total counter\n" +
+		`zeta_requests_total{x_region="eu",x_user_id="alice"} 1` + "\n" +
+		`zeta_requests_total{x_region="eu",x_user_id="bob"} 1` + "\n" +
+		`zeta_requests_total{x_region="eu",x_user_id="carol"} 1` + "\n"
+
+	first := plugin.renderPrometheusFormat()
+	if first != expected {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", first, expected)
+	}
+
+	for i := 0; i < 10; i++ {
+		if output := plugin.renderPrometheusFormat(); output != first {
+			t.Fatalf("render %d differs from the first render:\n%s\nwant:\n%s", i, output, first)
+		}
+	}
+}
+
+func TestValueRegex(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.ValueRegex = `total=([0-9.]+)ms`
+	cfg.Metrics = []MetricDefinition{
+		{Name: "value_regex_test", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Timing"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "value-regex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second value does not match and falls back to 1
+	for _, value := range []string{"total=123ms; db=45ms", "db=45ms"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Timing", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`value_regex_test_sum{x_tenant="acme"} 124`,
+		`value_regex_test_count{x_tenant="acme"} 2`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestInvalidValueRegex(t *testing.T) {
+	for _, pattern := range []string{`total=[0-9]+`, `(\w+)=([0-9]+)`, `total=([0-9]+`} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.ValueRegex = pattern
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-value-regex-test"); err == nil {
+			t.Errorf("expected error for valueRegex %q", pattern)
+		}
+	}
+}
+
+func TestAppendTotalSuffix(t *testing.T) {
+	tests := []struct {
+		appendTotalSuffix bool
+		expected          []string
+	}{
+		{
+			appendTotalSuffix: true,
+			expected: []string{
+				"# TYPE suffix_requests_total counter\n",
+				`suffix_requests_total{x_user_id="user123"} 1` + "\n",
+				"# TYPE suffix_bytes_total counter\n",
+				`suffix_bytes_total{x_user_id="user123"} 1` + "\n",
+				"# TYPE suffix_queue_depth gauge\n",
+				`suffix_queue_depth{x_user_id="user123"} 3` + "\n",
+			},
+		},
+		{
+			appendTotalSuffix: false,
+			expected: []string{
+				"# TYPE suffix_requests counter\n",
+				`suffix_requests{x_user_id="user123"} 1` + "\n",
+				"# TYPE suffix_queue_depth gauge\n",
+				`suffix_queue_depth{x_user_id="user123"} 3` + "\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		cfg.AppendTotalSuffix = test.appendTotalSuffix
+		cfg.Metrics = []MetricDefinition{
+			{Name: "suffix_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+			{Name: "suffix_bytes_total", Type: "counter", Headers: []string{"X-User-ID"}},
+			{Name: "suffix_queue_depth", Type: "gauge", Headers: []string{"X-User-ID"}, ValueHeader: "X-Queue-Depth"},
+		}
+
+		ctx := context.Background()
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})
+
+		handler, err := New(ctx, next, cfg, "append-total-suffix-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Queue-Depth", "3")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+
+		output := plugin.renderPrometheusFormat()
+		for _, line := range test.expected {
+			if !strings.Contains(output, line) {
+				t.Errorf("appendTotalSuffix=%t: expected output to contain %q, got:\n%s", test.appendTotalSuffix, line, output)
+			}
+		}
+		if strings.Contains(output, "_total_total") || strings.Contains(output, "suffix_queue_depth_total") {
+			t.Errorf("appendTotalSuffix=%t: unexpected suffix in output:\n%s", test.appendTotalSuffix, output)
+		}
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		gaugeSkipMissing bool
+		expected         []string
+	}{
+		{
+			gaugeSkipMissing: false,
+			expected: []string{
+				`default_value_gauge{x_tenant="acme"} 0`,
+				`default_value_histogram_sum{x_tenant="acme"} 5`,
+				`default_value_histogram_count{x_tenant="acme"} 2`,
+			},
+		},
+		{
+			gaugeSkipMissing: true,
+			expected: []string{
+				`default_value_gauge{x_tenant="acme"} 5`,
+				`default_value_histogram_sum{x_tenant="acme"} 5`,
+				`default_value_histogram_count{x_tenant="acme"} 2`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		cfg.DefaultValue = 0
+		cfg.GaugeSkipMissing = test.gaugeSkipMissing
+		cfg.Metrics = []MetricDefinition{
+			{Name: "default_value_gauge", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+			{Name: "default_value_histogram", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+		}
+
+		ctx := context.Background()
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})
+
+		handler, err := New(ctx, next, cfg, "default-value-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The second request carries no value
+		for _, value := range []string{"5", ""} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Tenant", "acme")
+			req.Header.Set("X-Value", value)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+
+		output := plugin.renderPrometheusFormat()
+		for _, line := range test.expected {
+			if !strings.Contains(output, line+"\n") {
+				t.Errorf("gaugeSkipMissing=%t: expected output to contain %q, got:\n%s", test.gaugeSkipMissing, line, output)
+			}
+		}
+	}
+}
+
+func TestGaugeSkipMissingWithoutSeries(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.GaugeSkipMissing = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "skip_missing_gauge", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "skip-missing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	if output := plugin.renderPrometheusFormat(); strings.Contains(output, "skip_missing_gauge{") {
+		t.Errorf("expected no series without a value, got:\n%s", output)
+	}
+}
+
+func TestMeasureDurationIndependentOfHeaderMetric(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.MeasureDuration = true
+	cfg.GaugeSkipMissing = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "independent_gauge", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "independent-duration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// The gauge has no value to record, but the request was still timed
+	output := plugin.renderPrometheusFormat()
+	if strings.Contains(output, "independent_gauge{") {
+		t.Errorf("expected no gauge series, got:\n%s", output)
+	}
+	if !strings.Contains(output, `independent_gauge_duration_seconds_count{x_tenant="acme"} 1`+"\n") {
+		t.Errorf("expected the duration histogram to be recorded, got:\n%s", output)
+	}
+}
+
+func TestFractionalAndNonFiniteValues(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "fractional_gauge", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+		{Name: "fractional_histogram", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "fractional-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Non-finite values are dropped for the histogram, leaving the earlier samples intact, and kept by the gauge
+	for _, value := range []string{"1023.5", "0.125", "NaN", "+Inf", "-Inf"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Value", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`fractional_gauge{x_tenant="acme"} -Inf`,
+		`fractional_histogram_sum{x_tenant="acme"} 1023.625`,
+		`fractional_histogram_count{x_tenant="acme"} 2`,
+		`custommetrics_dropped_samples_total{plugin="fractional-test"} 3`,
+	} {
+		if !strings.Contains(output, "\n"+line+"\n") {
+			t.Errorf("expected output to contain the line %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestMeasureSize(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "size_test"
+	cfg.DisableServer = true
+	cfg.MeasureSize = true
+
+	ctx := context.Background()
+	var written int
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body)
+
+		// Several writes, as with a chunked response
+		for _, chunk := range []string{"hello ", "chunked ", "world"} {
+			n, _ := rw.Write([]byte(chunk))
+			written += n
+		}
+	})
+
+	handler, err := New(ctx, next, cfg, "size-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A body of known length
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", strings.NewReader("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// A body of unknown length is counted as it is read
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", io.NopCloser(strings.NewReader("12345")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`size_test_request_bytes_total{x_tenant="acme"} 9`,
+		fmt.Sprintf(`size_test_response_bytes_total{x_tenant="acme"} %d`, written),
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestResponseSizeMetric(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "response_size_test"
+	cfg.DisableServer = true
+	cfg.ResponseSizeMetric = true
+	cfg.SizeBuckets = []float64{10, 1000}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The declared length is not what is counted
+		rw.Header().Set("Content-Length", "1000000")
+		if req.URL.Path == "/empty" {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for _, chunk := range []string{"hello ", "chunked ", "world"} {
+			_, _ = rw.Write([]byte(chunk))
+		}
+	})
+
+	handler, err := New(ctx, next, cfg, "response-size-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/empty"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`# TYPE response_size_test_response_bytes histogram`,
+		`response_size_test_response_bytes_bucket{x_tenant="acme",le="10"} 1`,
+		`response_size_test_response_bytes_bucket{x_tenant="acme",le="1000"} 2`,
+		`response_size_test_response_bytes_sum{x_tenant="acme"} 19`,
+		`response_size_test_response_bytes_count{x_tenant="acme"} 2`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestResponseSizeMetricWithMeasureSize(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.DisableServer = true
+	cfg.ResponseSizeMetric = true
+	cfg.MeasureSize = true
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "response-size-conflict-test"); err == nil {
+		t.Error("expected error when combining responseSizeMetric and measureSize")
+	}
+}
+
+// closeRecordingBody is a request body recording whether it was closed.
+type closeRecordingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeRecordingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRequestSizeMetric(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-API-Key"}
+	cfg.MetricName = "request_size_test"
+	cfg.DisableServer = true
+	cfg.RequestSizeMetric = true
+	cfg.SizeBuckets = []float64{4, 100}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+	})
+
+	handler, err := New(ctx, next, cfg, "request-size-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A body of known length
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", strings.NewReader("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", "key1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// A chunked upload is counted as it is read, and still closed by the handler
+	body := &closeRecordingBody{Reader: strings.NewReader(strings.Repeat("x", 50))}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	req.Header.Set("X-API-Key", "key1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !body.closed {
+		t.Error("expected closing the counted body to close the original body")
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`# TYPE request_size_test_request_bytes histogram`,
+		`request_size_test_request_bytes_bucket{x_api_key="key1",le="4"} 1`,
+		`request_size_test_request_bytes_bucket{x_api_key="key1",le="100"} 2`,
+		`request_size_test_request_bytes_sum{x_api_key="key1"} 54`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestRequestSizeMetricDoesNotReadBody(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-API-Key"}
+	cfg.MetricName = "unread_body_test"
+	cfg.DisableServer = true
+	cfg.RequestSizeMetric = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "unread-body-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler never reads the chunked body, so neither does the plugin
+	reader := strings.NewReader("unread")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost", io.NopCloser(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+	req.Header.Set("X-API-Key", "key1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if reader.Len() != len("unread") {
+		t.Errorf("expected the body to be left unread, %d bytes remain", reader.Len())
+	}
+	expected := `unread_body_test_request_bytes_sum{x_api_key="key1"} 0`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
+
+func TestMethodLabelNormalization(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "method_label_test"
+	cfg.DisableServer = true
+	cfg.IncludeMethod = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "method-label-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, "get", "PURGE", "PROPFIND"} {
+		req, err := http.NewRequestWithContext(ctx, method, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	expected := []string{
+		`method_label_test_total{method="GET",x_tenant="acme"} 2`,
+		`method_label_test_total{method="OTHER",x_tenant="acme"} 2`,
+		`method_label_test_total{method="POST",x_tenant="acme"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+	if series := strings.Count(output, "method_label_test_total{"); series != len(expected) {
+		t.Errorf("expected %d series, got %d:\n%s", len(expected), series, output)
+	}
+}
+
+func TestTrackInFlight(t *testing.T) {
+	const requests = 20
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "in_flight_test"
+	cfg.DisableServer = true
+	cfg.TrackInFlight = true
+
+	ctx := context.Background()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	handler, err := New(ctx, next, cfg, "in-flight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.Header.Set("X-Tenant", "acme")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		<-entered
+	}
+
+	inFlight := fmt.Sprintf(`in_flight_test_in_flight{x_tenant="acme"} %d`, requests)
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, inFlight+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", inFlight, output)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, `in_flight_test_in_flight{x_tenant="acme"} 0`+"\n") {
+		t.Errorf("expected the in-flight gauge to return to zero, got:\n%s", output)
+	}
+}
+
+func TestTrackInFlightWithPanic(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "in_flight_panic_test"
+	cfg.DisableServer = true
+	cfg.TrackInFlight = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	handler, err := New(context.Background(), next, cfg, "in-flight-panic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, `in_flight_panic_test_in_flight{x_tenant="acme"} 0`+"\n") {
+		t.Errorf("expected the in-flight gauge to return to zero after a panic, got:\n%s", output)
+	}
+}
+
+func TestGaugeAggregation(t *testing.T) {
+	tests := []struct {
+		aggregation string
+		expected    string
+	}{
+		{aggregation: "", expected: "1"},
+		{aggregation: GaugeAggregationLast, expected: "1"},
+		{aggregation: GaugeAggregationMax, expected: "10"},
+		{aggregation: GaugeAggregationMin, expected: "1"},
+		{aggregation: GaugeAggregationAvg, expected: "5"},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		cfg.GaugeAggregation = test.aggregation
+		cfg.Metrics = []MetricDefinition{
+			{Name: "aggregation_test", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+		}
+
+		ctx := context.Background()
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		handler, err := New(ctx, next, cfg, "aggregation-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+
+		send := func(value string) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Tenant", "acme")
+			req.Header.Set("X-Value", value)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		for _, value := range []string{"4", "10", "1"} {
+			send(value)
+
+			// JSON reads and exports leave the window to the next scrape
+			if _, err := renderJSON([]*MetricsStore{plugin.store}); err != nil {
+				t.Fatal(err)
+			}
+			encodeOTLPRequest(plugin.store, time.Now())
+			if err := writeStores(io.Discard, []*MetricsStore{plugin.store}, plugin.serverOptions, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line := `aggregation_test{x_tenant="acme"} ` + test.expected
+		if output := plugin.renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+			t.Errorf("aggregation %q: expected output to contain %q, got:\n%s", test.aggregation, line, output)
+		}
+
+		// The scrape closed the window, so the next observation starts afresh
+		send("7")
+		line = `aggregation_test{x_tenant="acme"} 7`
+		if output := plugin.renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+			t.Errorf("aggregation %q: expected output to contain %q after a scrape, got:\n%s", test.aggregation, line, output)
+		}
+	}
+}
+
+// gaugeAfter sends the values to a gauge in the given mode, leaving X-Delta out for empty values,
+// and returns the rendered value of the gauge. Scrapes in between do not affect the outcome.
+func gaugeAfter(t *testing.T, mode string, values ...string) string {
+	t.Helper()
+
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.GaugeMode = mode
+	cfg.Metrics = []MetricDefinition{
+		{Name: "queue_depth", Type: "gauge", Headers: []string{"X-Queue"}, ValueHeader: "X-Delta"},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "gauge-mode-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	for _, value := range values {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Queue", "jobs")
+		if value != "" {
+			req.Header.Set("X-Delta", value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		plugin.renderPrometheusFormat()
+	}
+
+	for _, metric := range plugin.store.snapshot(false) {
+		return formatValue(metric.Value)
+	}
+	return ""
+}
+
+func TestGaugeModeSet(t *testing.T) {
+	// Missing values set the default value, as before gauge modes
+	if value := gaugeAfter(t, GaugeModeSet, "4", "+10", "2"); value != "2" {
+		t.Errorf("expected 2, got %s", value)
+	}
+	if value := gaugeAfter(t, GaugeModeSet, "4", ""); value != "1" {
+		t.Errorf("expected the default value 1, got %s", value)
+	}
+}
+
+func TestGaugeModeAdd(t *testing.T) {
+	// Unparsable and missing deltas leave the gauge untouched
+	if value := gaugeAfter(t, GaugeModeAdd, "+5", "-3", "oops", "", "+10", "-0.5"); value != "11.5" {
+		t.Errorf("expected 11.5, got %s", value)
+	}
+}
+
+func TestGaugeModeMax(t *testing.T) {
+	if value := gaugeAfter(t, GaugeModeMax, "-4", "-7", "oops", "", "-2", "-9"); value != "-2" {
+		t.Errorf("expected -2, got %s", value)
+	}
+}
+
+func TestGaugeModeMin(t *testing.T) {
+	if value := gaugeAfter(t, GaugeModeMin, "4", "7", "oops", "", "+2", "9"); value != "2" {
+		t.Errorf("expected 2, got %s", value)
+	}
+}
+
+func TestInvalidGaugeMode(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Queue"}
+	cfg.DisableServer = true
+	cfg.GaugeMode = "sub"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-gauge-mode-test"); err == nil {
+		t.Error("expected error for an unknown gauge mode")
+	}
+
+	cfg.GaugeMode = GaugeModeAdd
+	cfg.GaugeAggregation = GaugeAggregationAvg
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-gauge-mode-test"); err == nil {
+		t.Error("expected error for a gauge aggregation outside the set mode")
+	}
+}
+
+func TestInvalidGaugeAggregation(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.GaugeAggregation = "median"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	if _, err := New(context.Background(), next, cfg, "invalid-aggregation-test"); err == nil {
+		t.Error("expected error for an unknown gauge aggregation")
+	}
+}
+
+func TestMetricQueryParams(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricQueryParams = []string{"tenant", "plan"}
+	cfg.MetricName = "query_params_test"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "query-params-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rawQuery := range []string{
+		"tenant=acme&plan=pro",
+		"tenant=acme&tenant=other&plan=pro", // Repeated parameters use the first value
+		"tenant=big%20corp%2Fus&plan=free",  // URL-encoded values are decoded
+		"plan=free",                         // Missing parameters become empty labels
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/?"+rawQuery, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`query_params_test_total{plan="pro",tenant="acme",x_user_id="user123"} 2`,
+		`query_params_test_total{plan="free",tenant="big corp/us",x_user_id="user123"} 1`,
+		`query_params_test_total{plan="free",tenant="",x_user_id="user123"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestMetricCookies(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricCookies = []string{"plan-tier"}
+	cfg.MetricName = "cookies_test"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "cookies-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range []string{
+		"plan-tier=gold",
+		`plan-tier="gold"`,          // Quoted values are unquoted by net/http
+		"session=x; plan-tier=it's", // Other cookies are ignored
+		`plan-tier=a"b`,             // net/http drops values with embedded quotes, like a missing cookie
+		"",
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`cookies_test_total{plan_tier="gold",x_user_id="user123"} 2`,
+		`cookies_test_total{plan_tier="it's",x_user_id="user123"} 1`,
+		`cookies_test_total{plan_tier="",x_user_id="user123"} 2`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+
+	// Values reaching the renderer with quotes are escaped
+	quoted := &series{Metric: Metric{
+		Name:   "cookies_test",
+		Type:   MetricTypeCounter,
+		Labels: map[string]string{"plan_tier": `"gold"`, "x_user_id": "user123"},
+	}}
+	quoted.addCounter(1)
+	plugin.store.put("quoted", quoted)
+
+	line := `cookies_test_total{plan_tier="\"gold\"",x_user_id="user123"} 1`
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", line, output)
+	}
+}
+
+func TestHeaderExtractors(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Client-Info", "X-Tenant"}
+	cfg.MetricName = "extractors_test"
+	cfg.DisableServer = true
+	cfg.HeaderExtractors = map[string]string{"x-client-info": `^(\w+)/`}
+	cfg.HeaderExtractorDefault = "unknown"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "extractors-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clientInfo := range []string{"ios/5.2.1 build 9981", "ios/5.3.0 build 10020", "android/14.1", "curl", ""} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Client-Info", clientInfo)
+		req.Header.Set("X-Tenant", "acme/eu")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`extractors_test_total{x_client_info="ios",x_tenant="acme/eu"} 2`,
+		`extractors_test_total{x_client_info="android",x_tenant="acme/eu"} 1`,
+		`extractors_test_total{x_client_info="unknown",x_tenant="acme/eu"} 1`,
+		`extractors_test_total{x_client_info="",x_tenant="acme/eu"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestInvalidHeaderExtractors(t *testing.T) {
+	for _, extractors := range []map[string]string{
+		{"X-Client-Info": `^(\w+/`},
+		{"X-Client-Info": `^\w+/`},
+		{"X-Other": `^(\w+)/`},
+	} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Client-Info"}
+		cfg.DisableServer = true
+		cfg.HeaderExtractors = extractors
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-extractors-test"); err == nil {
+			t.Errorf("expected error for headerExtractors %v", extractors)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "const_labels_test"
+	cfg.DisableServer = true
+	cfg.MaxSeries = 1
+	cfg.ConstLabels = map[string]string{"cluster": "eu-west"}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "const-labels-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Overflow and internal series carry the const labels too
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`const_labels_test_total{cluster="eu-west",x_user_id="alice"} 1`,
+		`const_labels_test_total{cluster="eu-west",x_user_id="__overflow__"} 1`,
+		`custommetrics_overflow_observations_total{cluster="eu-west",plugin="const-labels-test"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestConstLabelPrecedence(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID", "X-Env"}
+	cfg.MetricName = "const_precedence_test"
+	cfg.DisableServer = true
+	cfg.DisableSelfMetrics = true
+	cfg.IncludeMethod = true
+	cfg.ConstLabels = map[string]string{"X-Env": "prod", "method": "any", "1zone": "a"}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "const-precedence-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests differing only by labels the const labels override share a series
+	for _, request := range []struct{ method, env string }{
+		{http.MethodGet, "dev"},
+		{http.MethodPost, "staging"},
+	} {
+		req, err := http.NewRequestWithContext(ctx, request.method, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "alice")
+		req.Header.Set("X-Env", request.env)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := "# HELP const_precedence_test_total Custom metric based on HTTP headers\n" +
+		"# TYPE const_precedence_test_total counter\n" +
+		`const_precedence_test_total{_1zone="a",method="any",x_env="prod",x_user_id="alice"} 2` + "\n"
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); output != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestInvalidConstLabels(t *testing.T) {
+	for _, test := range []struct {
+		constLabels map[string]string
+		unsanitized bool
+	}{
+		{constLabels: map[string]string{"Cluster": "eu-west", "cluster": "us-east"}},
+		{constLabels: map[string]string{"cluster-name": "eu-west"}, unsanitized: true},
+		{constLabels: map[string]string{"__cluster": "eu-west"}, unsanitized: true},
+	} {
+		constLabels := test.constLabels
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.ConstLabels = constLabels
+		cfg.DisableLabelSanitization = test.unsanitized
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-const-labels-test"); err == nil {
+			t.Errorf("expected error for const labels %v", constLabels)
+		}
+	}
+}
+
+func TestLabelNameCollisions(t *testing.T) {
+	tests := []struct {
+		cfg      func(cfg *Config)
+		contains string
+	}{
+		{
+			cfg:      func(cfg *Config) { cfg.MetricHeaders = []string{"X-User-ID", "X_User.ID"} },
+			contains: `header "X-User-ID" and header "X_User.ID" both map to label "x_user_id"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.MetricHeaders = []string{"X-Tenant"}
+				cfg.MetricQueryParams = []string{"x.tenant"}
+			},
+			contains: `header "X-Tenant" and query parameter "x.tenant" both map to label "x_tenant"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.MetricHeaders = []string{"X-Tenant"}
+				cfg.IncludeHost = true
+				cfg.LabelTemplates = map[string]string{"host": "{{.Host}}"}
+			},
+			contains: `label template "host" collides with the label derived from includeHost`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.MetricHeaders = []string{"Status"}
+				cfg.StatusCodeLabel = true
+			},
+			contains: `header "Status" and statusCodeLabel both map to label "status"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.MetricHeaders = []string{"X-Tenant"}
+				cfg.MetricQueryParams = []string{"host"}
+				cfg.IncludeHost = true
+			},
+			contains: `query parameter "host" and includeHost both map to label "host"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.Metrics = []MetricDefinition{{Name: "cookies", Type: MetricTypeCounter, Cookies: []string{"Method"}}}
+				cfg.IncludeMethod = true
+			},
+			contains: `cookie "Method" and includeMethod both map to label "method"`,
+		},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableServer = true
+		test.cfg(cfg)
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		_, err := New(context.Background(), next, cfg, "label-collision-test")
+		if err == nil || !strings.Contains(err.Error(), test.contains) {
+			t.Errorf("expected error containing %q, got %v", test.contains, err)
+		}
+	}
+}
+
+func TestDisableLabelSanitization(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID", "X_User.ID"}
+	cfg.MetricName = "unsanitized_test"
+	cfg.DisableServer = true
+	cfg.DisableLabelSanitization = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	// Without sanitization the two headers keep distinct label names
+	handler, err := New(ctx, next, cfg, "unsanitized-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	line := `unsanitized_test_total{X-User-ID="user123",X_User.ID=""} 1`
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", line, output)
+	}
+}
+
+func TestOmitEmptyLabels(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID", "X-Tenant"}
+	cfg.MetricName = "omit_empty_test"
+	cfg.DisableServer = true
+	cfg.OmitEmptyLabels = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "omit-empty-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, headers := range []map[string]string{
+		{"X-User-ID": "user123", "X-Tenant": "acme"},
+		{"X-User-ID": "user123"},
+		{"X-User-ID": "user123"},
+		{},
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Requests with and without a header land in different series, without empty labels
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`omit_empty_test_total{x_tenant="acme",x_user_id="user123"} 1`,
+		`omit_empty_test_total{x_user_id="user123"} 2`,
+		`omit_empty_test_total 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `=""`) {
+		t.Errorf("expected no empty labels, got:\n%s", output)
+	}
+	if count := plugin.store.seriesCount(); count != 3 {
+		t.Errorf("expected 3 series, got %d", count)
+	}
+}
+
+func TestMetricHelp(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "help_requests", Type: "counter", Headers: []string{"X-User-ID"}, Help: "Requests per user.\nSee C:\\docs"},
+		{Name: "help_default", Type: "counter", Headers: []string{"X-User-ID"}},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "help-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Newlines and backslashes are escaped, and metrics without help keep the default
+	output := handler.(*CustomMetrics).renderPrometheusFormat()
+	for _, line := range []string{
+		`# HELP help_requests_total Requests per user.\nSee C:\\docs`,
+		"# HELP help_default_total " + DefaultMetricHelp,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestTopLevelMetricHelp(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "top_level_help"
+	cfg.MetricHelp = "Requests per user"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "top-level-help-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := "# HELP top_level_help_total Requests per user"
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", line, output)
+	}
+}
+
+func TestMetricHelpEscapingPerFormat(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "quoted_help"
+	cfg.MetricHelp = `Requests per "user" in C:\users`
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "quoted-help-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Only OpenMetrics escapes double quotes in HELP text
+	plugin := handler.(*CustomMetrics)
+	if line := `# HELP quoted_help_total Requests per "user" in C:\\users`; !strings.Contains(plugin.renderPrometheusFormat(), line+"\n") {
+		t.Errorf("expected the Prometheus output to contain %q, got:\n%s", line, plugin.renderPrometheusFormat())
+	}
+	if line := `# HELP quoted_help Requests per \"user\" in C:\\users`; !strings.Contains(plugin.renderOpenMetricsFormat(), line+"\n") {
+		t.Errorf("expected the OpenMetrics output to contain %q, got:\n%s", line, plugin.renderOpenMetricsFormat())
+	}
+}
+
+func TestMultiValueStrategy(t *testing.T) {
+	tests := []struct {
+		strategy  string
+		separator string
+		expected  string
+	}{
+		{strategy: MultiValueFirst, expected: `multi_value_test_total{x_tag="a"} 1`},
+		{strategy: MultiValueJoin, expected: `multi_value_test_total{x_tag="a,b,c"} 1`},
+		{strategy: MultiValueJoin, separator: "|", expected: `multi_value_test_total{x_tag="a|b|c"} 1`},
+		{strategy: MultiValueCount, expected: `multi_value_test_total{x_tag="3"} 1`},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tag"}
+		cfg.MetricName = "multi_value_test"
+		cfg.DisableServer = true
+		cfg.MultiValueStrategy = test.strategy
+		cfg.MultiValueSeparator = test.separator
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "multi-value-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{"a", "b", "c"} {
+			req.Header.Add("X-Tag", value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, test.expected+"\n") {
+			t.Errorf("%s: expected output to contain %q, got:\n%s", test.strategy, test.expected, output)
+		}
+	}
+}
+
+func TestMultiValueJoinAppliesExtractors(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Client-Info"}
+	cfg.MetricName = "multi_value_extract_test"
+	cfg.DisableServer = true
+	cfg.MultiValueStrategy = MultiValueJoin
+	cfg.HeaderExtractors = map[string]string{"X-Client-Info": `^(\w+)/`}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "multi-value-extract-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Client-Info", "ios/5.2.1")
+	req.Header.Add("X-Client-Info", "android/14")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := `multi_value_extract_test_total{x_client_info="ios,android"} 1`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
+
+func TestInvalidMultiValueStrategy(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tag"}
+	cfg.DisableServer = true
+	cfg.MultiValueStrategy = "last"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-multi-value-test"); err == nil {
+		t.Error("expected error for an unknown multiValueStrategy")
+	}
+}
+
+// BenchmarkRenderPrometheusFormat writes the exposition of 100k counter series.
+func BenchmarkRenderPrometheusFormat(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "render_benchmark"
+	cfg.DisableServer = true
+	cfg.MaxSeries = 0
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "render-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		b.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	definition := plugin.definitions[0]
+	for i := 0; i < 100000; i++ {
+		labels := map[string]string{"x_user_id": strconv.Itoa(i)}
+		plugin.getSeries(plugin.createMetricKey(definition.Name, labels), definition, nil, labels).addCounter(1)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := plugin.writePrometheusFormat(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			t.Fatal("expected the response writer to be a http.Flusher")
+		}
+		_, _ = rw.Write([]byte("data: event\n\n"))
+		flusher.Flush()
+	})
+
+	handler, err := New(ctx, next, cfg, "flush-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if !recorder.Flushed {
+		t.Error("expected the flush to reach the underlying writer")
+	}
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "hijack_test"
+	cfg.DisableServer = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			t.Error("expected the response writer to be a http.Hijacker")
+			return
+		}
+		conn, buffered, err := hijacker.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello")
+		_ = buffered.Flush()
+	})
+
+	handler, err := New(context.Background(), next, cfg, "hijack-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-User-ID: user123\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 101 Switching Protocols\r\n") || !strings.HasSuffix(string(response), "hello") {
+		t.Errorf("expected the handler to answer over the hijacked connection, got %q", response)
+	}
+}
+
+// readerFromRecorder is a response writer recording the bodies copied with ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom int64
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseRecorder, src)
+	r.readFrom += n
+	return n, err
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "read_from_test"
+	cfg.DisableServer = true
+	cfg.MeasureSize = true
 
 	ctx := context.Background()
 	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		rw.WriteHeader(http.StatusOK)
+		readerFrom, ok := rw.(io.ReaderFrom)
+		if !ok {
+			t.Fatal("expected the response writer to be an io.ReaderFrom")
+		}
+		_, _ = readerFrom.ReadFrom(strings.NewReader("file contents"))
 	})
 
-	handler, err := New(ctx, next, cfg, "benchmark-plugin")
+	handler, err := New(ctx, next, cfg, "read-from-test")
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
 
-	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			// Create a new request for each iteration
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.readFrom != int64(len("file contents")) {
+		t.Errorf("expected the body to be copied with the underlying ReadFrom, copied %d bytes", recorder.readFrom)
+	}
+	expected := `read_from_test_response_bytes_total{x_user_id="user123"} 13`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		scale    bool
+		min, max float64
+	}{
+		{rate: 1e-9, min: 0, max: 0},
+		{rate: 1, min: 1000, max: 1000},
+		{rate: 1, scale: true, min: 1000, max: 1000},
+		// Scaled totals estimate every request, unscaled ones only count the sample
+		{rate: 0.5, scale: true, min: 800, max: 1200},
+		{rate: 0.5, min: 400, max: 600},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.DisableSelfMetrics = true
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricName = "sampled_requests"
+		cfg.DisableServer = true
+		cfg.SampleRate = test.rate
+		cfg.ScaleSampledCounters = test.scale
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "sample-rate-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
 			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
 			if err != nil {
-				b.Fatal(err)
+				t.Fatal(err)
 			}
 			req.Header.Set("X-User-ID", "user123")
-			recorder := httptest.NewRecorder()
-			handler.ServeHTTP(recorder, req)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		var total float64
+		for _, metric := range handler.(*CustomMetrics).store.snapshot(false) {
+			total += metric.Value
+		}
+		if total < test.min || total > test.max {
+			t.Errorf("rate %v, scaled %t: expected a total within [%v, %v], got %v", test.rate, test.scale, test.min, test.max, total)
+		}
+	}
+}
+
+func TestInvalidSampleRate(t *testing.T) {
+	for _, rate := range []float64{0, -0.5, 1.5, math.NaN()} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.SampleRate = rate
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-sample-rate-test"); err == nil {
+			t.Errorf("expected error for sampleRate %v", rate)
+		}
+	}
+}
+
+func TestAllowedValues(t *testing.T) {
+	tests := []struct {
+		caseInsensitive bool
+		tenant          string
+		expected        string
+	}{
+		{tenant: "b", expected: `allowed_values_test_total{x_region="eu-west",x_tenant="b"} 1`},
+		{tenant: "zzz", expected: `allowed_values_test_total{x_region="eu-west",x_tenant="unlisted"} 1`},
+		{tenant: "B", expected: `allowed_values_test_total{x_region="eu-west",x_tenant="unlisted"} 1`},
+		{caseInsensitive: true, tenant: "B", expected: `allowed_values_test_total{x_region="eu-west",x_tenant="b"} 1`},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tenant", "X-Region"}
+		cfg.MetricName = "allowed_values_test"
+		cfg.DisableServer = true
+		cfg.AllowedValues = map[string][]string{"x-tenant": {"a", "b", "c"}}
+		cfg.AllowedValuesOther = "unlisted"
+		cfg.AllowedValuesCaseInsensitive = test.caseInsensitive
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "allowed-values-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// X-Region has no allowed values, so it passes through unchanged
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", test.tenant)
+		req.Header.Set("X-Region", "eu-west")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, test.expected+"\n") {
+			t.Errorf("tenant %q: expected output to contain %q, got:\n%s", test.tenant, test.expected, output)
+		}
+	}
+}
+
+func TestAllowedValuesForUnknownHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.DisableServer = true
+	cfg.AllowedValues = map[string][]string{"X-Region": {"eu"}}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "allowed-values-unknown-test"); err == nil {
+		t.Error("expected error for allowed values of a header that is not a label")
+	}
+}
+
+func TestIncludeHost(t *testing.T) {
+	tests := []struct {
+		trustForwarded bool
+		host           string
+		forwardedHost  string
+		expected       string
+	}{
+		{host: "Example.com:8443", expected: `host_test_total{host="example.com",x_tenant="a"} 1`},
+		{host: "[::1]:8080", expected: `host_test_total{host="::1",x_tenant="a"} 1`},
+		{host: "example.com", forwardedHost: "forged.example", expected: `host_test_total{host="example.com",x_tenant="a"} 1`},
+		{trustForwarded: true, host: "internal:80", forwardedHost: "public.example:443, proxy", expected: `host_test_total{host="public.example",x_tenant="a"} 1`},
+		{trustForwarded: true, host: "internal:80", expected: `host_test_total{host="internal",x_tenant="a"} 1`},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Tenant"}
+		cfg.MetricName = "host_test"
+		cfg.DisableServer = true
+		cfg.IncludeHost = true
+		cfg.TrustForwardedHost = test.trustForwarded
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "host-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = test.host
+		req.Header.Set("X-Tenant", "a")
+		if test.forwardedHost != "" {
+			req.Header.Set("X-Forwarded-Host", test.forwardedHost)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, test.expected+"\n") {
+			t.Errorf("host %q: expected output to contain %q, got:\n%s", test.host, test.expected, output)
+		}
+	}
+}
+
+func TestInvalidSummaryWindow(t *testing.T) {
+	tests := []struct {
+		maxSamples int
+		maxAge     string
+	}{
+		{maxSamples: -1},
+		{maxAge: "soon"},
+		{maxAge: "-1m"},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.SummaryMaxSamples = test.maxSamples
+		cfg.SummaryMaxAge = test.maxAge
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-summary-window-test"); err == nil {
+			t.Errorf("expected error for summaryMaxSamples %d and summaryMaxAge %q", test.maxSamples, test.maxAge)
+		}
+	}
+}
+
+func TestQueryParamLabelValues(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricQueryParams = []string{"region", "plan"}
+	cfg.MetricName = "query_label_values_test"
+	cfg.DisableServer = true
+	cfg.LabelTransforms = map[string][]string{"region": {"lower"}}
+	cfg.AllowedValues = map[string][]string{"region": {"eu", "us"}}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "query-label-values-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plan parameter is never sent
+	for _, rawQuery := range []string{"region=EU", "region=apac", ""} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/?"+rawQuery, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	output := handler.(*CustomMetrics).renderPrometheusFormat()
+	for _, line := range []string{
+		`query_label_values_test_total{plan="",region="eu",x_user_id="user123"} 1`,
+		`query_label_values_test_total{plan="",region="other",x_user_id="user123"} 1`,
+		`query_label_values_test_total{plan="",region="",x_user_id="user123"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+
+	// Query parameter names are case-sensitive
+	cfg.AllowedValues = map[string][]string{"Region": {"eu"}}
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "query-label-values-test"); err == nil {
+		t.Error("expected error for allowed values of a query parameter that is not a label")
+	}
+}
+
+func TestHeaderSources(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant", "X-Compute-Units"}
+	cfg.MetricName = "header_sources_test"
+	cfg.MetricType = MetricTypeGauge
+	cfg.DisableServer = true
+	cfg.HeaderSources = map[string]string{"x-compute-units": HeaderSourceResponse, "X-Tenant": HeaderSourceRequest}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Tenant", "upstream")
+		rw.Header().Set("X-Compute-Units", "7")
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "header-sources-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client spoofs X-Compute-Units, which is only read from the response
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Compute-Units", "1000")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := `header_sources_test{x_compute_units="7",x_tenant="acme"} 7`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+
+	cfg.HeaderSources = map[string]string{"X-Compute-Units": "upstream"}
+	if _, err := New(ctx, next, cfg, "header-sources-test"); err == nil {
+		t.Error("expected error for an unknown header source")
+	}
+}
+
+func TestHeaderOnBothSides(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant", "X-Units"}
+	cfg.MetricName = "both_sides_test"
+	cfg.MetricType = MetricTypeGauge
+	cfg.DisableServer = true
+	cfg.DefaultValue = -1
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Tenant", "upstream")
+		rw.Header().Set("X-Units", "7")
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "both-sides-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	// The value comes from the request like the label, and falls back to the default rather than
+	// to the response when it is not numeric there
+	for _, units := range []string{"1000", "lots"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Units", units)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if header := plugin.resolveHeader("X-Units", req, http.Header{"X-Units": {"7"}}); header.source != HeaderSourceRequest || header.first() != units {
+			t.Errorf("expected X-Units %q from the request, got %q from the %s", units, header.first(), header.source)
+		}
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, expected := range []string{
+		`both_sides_test{x_tenant="acme",x_units="1000"} 1000`,
+		`both_sides_test{x_tenant="acme",x_units="lots"} -1`,
+	} {
+		if !strings.Contains(output, expected+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestSnapshotAndGetMetric(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "snapshot_test"
+	cfg.DisableServer = true
+	cfg.ConstLabels = map[string]string{"env": "prod"}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	values := make(map[string]float64)
+	for _, metric := range plugin.Snapshot() {
+		if metric.Name == "snapshot_test" {
+			values[metric.Labels["x_user_id"]] = metric.Value
+		}
+	}
+	if len(values) != 2 || values["alice"] != 2 || values["bob"] != 1 {
+		t.Errorf("expected alice 2 and bob 1, got %v", values)
+	}
+
+	alice, ok := plugin.GetMetric("snapshot_test", map[string]string{"x_user_id": "alice", "env": "prod"})
+	if !ok || alice.Value != 2 || alice.Type != MetricTypeCounter || alice.LastUpdated.IsZero() {
+		t.Errorf("expected alice's series with 2 requests, got %+v, %v", alice, ok)
+	}
+
+	// Copies do not alias the series labels
+	alice.Labels["x_user_id"] = "mallory"
+	if _, ok := plugin.GetMetric("snapshot_test", map[string]string{"x_user_id": "alice", "env": "prod"}); !ok {
+		t.Error("expected modifying a copy to leave the series untouched")
+	}
+
+	for _, labels := range []map[string]string{
+		{"x_user_id": "alice"},
+		{"x_user_id": "alice", "env": "dev"},
+		{"x_user_id": "carol", "env": "prod"},
+	} {
+		if metric, ok := plugin.GetMetric("snapshot_test", labels); ok {
+			t.Errorf("expected no series for %v, got %+v", labels, metric)
+		}
+	}
+}
+
+func TestCookieLabelValues(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricCookies = []string{"session", "plan"}
+	cfg.MetricName = "cookie_label_values_test"
+	cfg.DisableServer = true
+	cfg.LabelTransforms = map[string][]string{"session": {"sha256:8"}}
+	cfg.AllowedValues = map[string][]string{"plan": {"gold"}}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "cookie-label-values-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plan cookie is never sent
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	req.Header.Set("Cookie", "session=abc123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := `cookie_label_values_test_total{plan="",session="6ca13d52",x_user_id="user123"} 1`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
+
+func TestGaugeFloatValues(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{header: "1.5", expected: "1.5"},
+		{header: "0.1", expected: "0.1"},
+		{header: "-2.25", expected: "-2.25"},
+		{header: "1000000", expected: "1000000"},
+		{header: "3", expected: "3"},
+		{header: "1e20", expected: "1e+20"},
+		{header: "0.000001", expected: "1e-06"},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-Queue-Depth"}
+		cfg.MetricName = "float_gauge_test"
+		cfg.MetricType = MetricTypeGauge
+		cfg.DisableServer = true
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "float-gauge-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Queue-Depth", test.header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		expected := `float_gauge_test{x_queue_depth="` + test.header + `"} ` + test.expected + "\n"
+		if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestRequireAnyLabel(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-Tenant", "X-Region"}
+	cfg.MetricName = "require_any_label_test"
+	cfg.DisableServer = true
+	cfg.RequireAnyLabel = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/upstream" {
+			rw.Header().Set("X-Region", "eu")
 		}
 	})
+
+	handler, err := New(ctx, next, cfg, "require-any-label-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		tenant string
+	}{
+		{path: "/", tenant: "acme"},
+		{path: "/"},
+		{path: "/"},
+		{path: "/upstream"}, // A response header is enough
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.tenant != "" {
+			req.Header.Set("X-Tenant", test.tenant)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	output := handler.(*CustomMetrics).renderPrometheusFormat()
+	for _, line := range []string{
+		`require_any_label_test_total{x_region="",x_tenant="acme"} 1`,
+		`require_any_label_test_total{x_region="eu",x_tenant=""} 1`,
+		`custommetrics_unlabeled_observations_total{plugin="require-any-label-test"} 2`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, `require_any_label_test_total{x_region="",x_tenant=""}`) {
+		t.Errorf("expected no series without label values, got:\n%s", output)
+	}
+}
+
+func TestNonFiniteValueTokens(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.DisableSelfMetrics = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "special_gauge", Type: MetricTypeGauge, Headers: []string{"X-Sensor"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "non-finite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	values := map[string]string{"nan": "NaN", "pos": "+Inf", "neg": "-Inf", "one": "1"}
+	for sensor, value := range values {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Sensor", sensor)
+		req.Header.Set("X-Value", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for format, output := range map[string]string{
+		ExpositionFormatPrometheus:  plugin.renderPrometheusFormat(),
+		ExpositionFormatOpenMetrics: plugin.renderOpenMetricsFormat(),
+	} {
+		for sensor, token := range values {
+			line := `special_gauge{x_sensor="` + sensor + `"} ` + token + "\n"
+			if !strings.Contains(output, line) {
+				t.Errorf("%s: expected output to contain %q, got:\n%s", format, line, output)
+			}
+		}
+	}
+
+	// JSON has no tokens for them, so only the finite gauge is listed
+	body, err := renderJSON([]*MetricsStore{plugin.store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []Metric
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Labels["x_sensor"] != "one" {
+		t.Errorf("expected only the finite gauge in JSON, got %s", body)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		cfg      func(cfg *Config)
+		contains string
+	}{
+		{
+			cfg:      func(cfg *Config) { cfg.MetricName = "my metric!" },
+			contains: `invalid metricName "my metric!"`,
+		},
+		{
+			cfg:      func(cfg *Config) { cfg.MetricName = "9lives" },
+			contains: `invalid metricName "9lives"`,
+		},
+		{
+			cfg:      func(cfg *Config) { cfg.MetricName = "custommetrics_requests" },
+			contains: "the custommetrics_ prefix is reserved",
+		},
+		{
+			cfg:      func(cfg *Config) { cfg.MetricType = "meter" },
+			contains: `invalid metricType "meter"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.Metrics = []MetricDefinition{
+					{Name: "requests", Type: MetricTypeCounter, Headers: []string{"X-User-ID"}},
+					{Name: "queue-depth", Type: MetricTypeGauge, Headers: []string{"X-Queue-Depth"}},
+				}
+			},
+			contains: `invalid metrics[1].name "queue-depth"`,
+		},
+		{
+			cfg: func(cfg *Config) {
+				cfg.Metrics = []MetricDefinition{{Name: "requests", Headers: []string{"X-User-ID"}}}
+			},
+			contains: `invalid metrics[0].type ""`,
+		},
+		{
+			cfg:      func(cfg *Config) { cfg.MetricsPort = -1 },
+			contains: "invalid metricsPort -1",
+		},
+		{
+			cfg:      func(cfg *Config) { cfg.MetricsPort = 65536 },
+			contains: "invalid metricsPort 65536",
+		},
+	}
+
+	for _, test := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		test.cfg(cfg)
+
+		_, err := New(context.Background(), http.NotFoundHandler(), cfg, "config-validation-test")
+		if err == nil || !strings.Contains(err.Error(), test.contains) {
+			t.Errorf("expected error containing %q, got %v", test.contains, err)
+		}
+	}
+
+	// Colons are valid in metric names
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "job:requests:rate"
+	cfg.DisableServer = true
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "config-validation-test"); err != nil {
+		t.Errorf("expected a metric name with colons to be accepted, got %v", err)
+	}
+}
+
+func TestAllowNoLabels(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricName = "no_labels_test"
+	cfg.DisableServer = true
+	cfg.AllowNoLabels = true
+	cfg.RequireAnyLabel = true // Has nothing to require without label sources
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "no-labels-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, "\nno_labels_test_total 3\n") {
+		t.Errorf("expected a single unlabeled series, got:\n%s", output)
+	}
+
+	// Gauges need a value header to have something to record
+	cfg.MetricType = MetricTypeGauge
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "no-labels-test"); err == nil {
+		t.Error("expected error for a gauge without headers")
+	}
+
+	cfg.Metrics = []MetricDefinition{{Name: "no_labels_depth", Type: MetricTypeGauge, ValueHeader: "X-Queue-Depth"}}
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "no-labels-test"); err != nil {
+		t.Errorf("expected a gauge with a value header to be accepted, got %v", err)
+	}
+
+	cfg.AllowNoLabels = false
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "no-labels-test"); err == nil {
+		t.Error("expected error for a metric without headers unless allowNoLabels is set")
+	}
 }
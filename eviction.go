@@ -0,0 +1,58 @@
+package custommetrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxSweepInterval caps how long expired series may linger before being swept.
+const maxSweepInterval = time.Minute
+
+// sweepInterval returns how often series are checked for expiry: a quarter of the TTL, at most a minute.
+func sweepInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 4
+	if interval > maxSweepInterval {
+		interval = maxSweepInterval
+	}
+	return interval
+}
+
+// runSweeper periodically evicts expired series until the plugin is stopped.
+func (c *CustomMetrics) runSweeper() {
+	ticker := time.NewTicker(sweepInterval(c.seriesTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweepExpiredSeries()
+		case <-c.serverStop:
+			return
+		}
+	}
+}
+
+// sweepExpiredSeries deletes series that have not been updated within the TTL.
+// Evicted counters start again from zero if their labels are seen again. In-flight gauges are
+// kept while they count requests, however long those take.
+func (c *CustomMetrics) sweepExpiredSeries() {
+	cutoff := c.now().Add(-c.seriesTTL)
+	for i := range c.store.shards {
+		c.sweepShard(&c.store.shards[i], cutoff)
+	}
+}
+
+// sweepShard deletes the series of one shard last updated before the cutoff.
+func (c *CustomMetrics) sweepShard(shard *storeShard, cutoff time.Time) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for key, metric := range shard.metrics {
+		if metric.lastUpdate().Before(cutoff) && !metric.countsRequests() {
+			delete(shard.metrics, key)
+			if !metric.overflow {
+				atomic.AddInt64(&c.store.series, -1)
+			}
+		}
+	}
+}
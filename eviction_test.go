@@ -0,0 +1,181 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSweepInterval(t *testing.T) {
+	tests := map[time.Duration]time.Duration{
+		time.Second:      250 * time.Millisecond,
+		2 * time.Minute:  30 * time.Second,
+		time.Hour:        time.Minute,
+		24 * time.Hour:   time.Minute,
+		4 * time.Minute:  time.Minute,
+		40 * time.Second: 10 * time.Second,
+	}
+
+	for ttl, expected := range tests {
+		if interval := sweepInterval(ttl); interval != expected {
+			t.Errorf("sweepInterval(%s): expected %s, got %s", ttl, expected, interval)
+		}
+	}
+}
+
+func TestSeriesTTLEviction(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "ttl_test"
+	cfg.MetricType = "counter"
+	cfg.DisableServer = true
+	cfg.SeriesTTL = "1h"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "ttl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	// Inject a fake clock
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	plugin.now = func() time.Time { return clock }
+
+	send := func(user string) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("stale")
+	send("stale")
+	clock = clock.Add(45 * time.Minute)
+	send("fresh")
+	clock = clock.Add(30 * time.Minute)
+
+	plugin.sweepExpiredSeries()
+
+	output := plugin.renderPrometheusFormat()
+	if strings.Contains(output, `x_user_id="stale"`) {
+		t.Errorf("expected stale series to be evicted, got:\n%s", output)
+	}
+	if !strings.Contains(output, `ttl_test_total{x_user_id="fresh"} 1`) {
+		t.Errorf("expected fresh series to be kept, got:\n%s", output)
+	}
+
+	// An evicted counter starts again from zero
+	send("stale")
+	output = plugin.renderPrometheusFormat()
+	if !strings.Contains(output, `ttl_test_total{x_user_id="stale"} 1`) {
+		t.Errorf("expected evicted counter to restart from zero, got:\n%s", output)
+	}
+
+	series := plugin.store.seriesCount()
+	if series != 2 {
+		t.Errorf("expected series count to be 2 after eviction, got %d", series)
+	}
+}
+
+func TestInvalidSeriesTTL(t *testing.T) {
+	for _, ttl := range []string{"soon", "-1m", "0s"} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.SeriesTTL = ttl
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-ttl"); err == nil {
+			t.Errorf("expected error for seriesTTL %q", ttl)
+		}
+	}
+}
+
+func TestSeriesTTLKeepsRequestsInFlight(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "ttl_in_flight_test"
+	cfg.DisableServer = true
+	cfg.SeriesTTL = "1h"
+	cfg.TrackInFlight = true
+
+	ctx := context.Background()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	handler, err := New(ctx, next, cfg, "ttl-in-flight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	// Inject a fake clock
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockMu sync.Mutex
+	plugin.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	}
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		clock = clock.Add(d)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-User-ID", "user1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-entered
+
+	// A request outliving the TTL keeps its gauge
+	advance(2 * time.Hour)
+	plugin.sweepExpiredSeries()
+	inFlight := `ttl_in_flight_test_in_flight{x_user_id="user1"}`
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, inFlight+" 1\n") {
+		t.Errorf("expected the in-flight gauge to be kept, got:\n%s", output)
+	}
+
+	close(release)
+	<-done
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, inFlight+" 0\n") {
+		t.Errorf("expected the in-flight gauge to return to zero, got:\n%s", output)
+	}
+
+	// Once idle it expires like any other series
+	advance(2 * time.Hour)
+	plugin.sweepExpiredSeries()
+	if output := plugin.renderPrometheusFormat(); output != "" {
+		t.Errorf("expected every series to be evicted, got:\n%s", output)
+	}
+}
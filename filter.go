@@ -0,0 +1,100 @@
+package custommetrics
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// pathFilter matches request paths by prefix, or as a glob when the pattern has wildcards.
+type pathFilter struct {
+	pattern string
+	glob    bool
+}
+
+// parsePathFilters parses the patterns of IncludePaths or ExcludePaths, rejecting malformed globs.
+func parsePathFilters(option string, patterns []string) ([]pathFilter, error) {
+	filters := make([]pathFilter, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("%s pattern %q must start with /", option, pattern)
+		}
+
+		glob := strings.ContainsAny(pattern, "*?[")
+		if glob {
+			// Match only reports malformed patterns when it gets to them, so try the whole pattern
+			if _, err := path.Match(pattern, pattern); err != nil {
+				return nil, fmt.Errorf("invalid %s pattern %q: %w", option, pattern, err)
+			}
+		}
+		filters = append(filters, pathFilter{pattern: pattern, glob: glob})
+	}
+	return filters, nil
+}
+
+// match reports whether a request path matches the filter. Globs follow path.Match, so "*"
+// does not cross slashes: "/api/*" matches "/api/users" but not "/api/users/1".
+func (f pathFilter) match(requestPath string) bool {
+	if f.glob {
+		matched, _ := path.Match(f.pattern, requestPath)
+		return matched
+	}
+	return strings.HasPrefix(requestPath, f.pattern)
+}
+
+// matchAny reports whether a request path matches any of the filters.
+func matchAny(filters []pathFilter, requestPath string) bool {
+	for _, filter := range filters {
+		if filter.match(requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// measures reports whether a request is in the scope of the plugin. Exclusions win over
+// inclusions, and empty inclusion lists include every path or method.
+func (c *CustomMetrics) measures(req *http.Request) bool {
+	if len(c.includeMethods) > 0 && !c.includeMethods[strings.ToUpper(req.Method)] {
+		return false
+	}
+	if matchAny(c.excludePaths, req.URL.Path) {
+		return false
+	}
+	return len(c.includePaths) == 0 || matchAny(c.includePaths, req.URL.Path)
+}
+
+// statusFilter matches response status codes by class, such as "5xx", or exactly, such as "429".
+type statusFilter struct {
+	classes map[int]bool
+	codes   map[int]bool
+}
+
+// parseStatusFilter parses the values of StatusCodeFilter. It returns nil when there are none.
+func parseStatusFilter(values []string) (*statusFilter, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	filter := &statusFilter{classes: make(map[int]bool), codes: make(map[int]bool)}
+	for _, value := range values {
+		if len(value) == 3 && value[0] >= '1' && value[0] <= '5' && strings.EqualFold(value[1:], "xx") {
+			filter.classes[int(value[0]-'0')] = true
+			continue
+		}
+
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("statusCodeFilter value %q must be a status class such as \"5xx\" or a status code such as \"429\"", value)
+		}
+		filter.codes[code] = true
+	}
+	return filter, nil
+}
+
+// match reports whether a status code is selected by the filter. A nil filter selects every status.
+func (f *statusFilter) match(status int) bool {
+	return f == nil || f.codes[status] || f.classes[status/100]
+}
@@ -0,0 +1,159 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathFilterMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{pattern: "/api/", path: "/api/users", expected: true},
+		{pattern: "/api/", path: "/apix", expected: false},
+		{pattern: "/ping", path: "/ping", expected: true},
+		{pattern: "/api/*", path: "/api/users", expected: true},
+		{pattern: "/api/*", path: "/api/users/1", expected: false},
+		{pattern: "/api/*/orders", path: "/api/v2/orders", expected: true},
+		{pattern: "/v?/users", path: "/v1/users", expected: true},
+	}
+
+	for _, test := range tests {
+		filters, err := parsePathFilters("includePaths", []string{test.pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := filters[0].match(test.path); matched != test.expected {
+			t.Errorf("%s matching %s: expected %v, got %v", test.pattern, test.path, test.expected, matched)
+		}
+	}
+}
+
+func TestInvalidPathFilters(t *testing.T) {
+	for _, pattern := range []string{"api/", "/api/[", "/api/[a-"} {
+		if _, err := parsePathFilters("excludePaths", []string{pattern}); err == nil {
+			t.Errorf("expected error for pattern %q", pattern)
+		}
+	}
+}
+
+func TestRequestFilters(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "filtered_requests"
+	cfg.DisableServer = true
+	cfg.IncludePaths = []string{"/api/"}
+	cfg.ExcludePaths = []string{"/api/ping"}
+	cfg.IncludeMethods = []string{"post"}
+
+	ctx := context.Background()
+	var served int
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { served++ })
+
+	handler, err := New(ctx, next, cfg, "filter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		measured bool
+	}{
+		{method: http.MethodPost, path: "/api/orders", measured: true},
+		{method: http.MethodGet, path: "/api/orders", measured: false},
+		{method: http.MethodPost, path: "/web/orders", measured: false},
+		{method: http.MethodPost, path: "/api/ping", measured: false},
+	}
+
+	plugin := handler.(*CustomMetrics)
+	for _, test := range tests {
+		before := plugin.store.seriesCount()
+
+		req, err := http.NewRequestWithContext(ctx, test.method, "http://localhost"+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", test.method+test.path)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if measured := plugin.store.seriesCount() > before; measured != test.measured {
+			t.Errorf("%s %s: expected measured %v, got %v", test.method, test.path, test.measured, measured)
+		}
+	}
+
+	// Every request still reaches the next handler
+	if served != len(tests) {
+		t.Errorf("expected %d requests to be served, got %d", len(tests), served)
+	}
+}
+
+func TestStatusCodeFilter(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "errors"
+	cfg.DisableServer = true
+	cfg.StatusCodeLabel = true
+	cfg.StatusCodeFilter = []string{"5xx", "429"}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/silent":
+			// Never writes, so counts as 200
+		case "/ok":
+			_, _ = rw.Write([]byte("ok"))
+		case "/limited":
+			rw.WriteHeader(http.StatusTooManyRequests)
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		default:
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	})
+
+	handler, err := New(ctx, next, cfg, "status-filter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/silent", "/ok", "/limited", "/missing", "/broken", "/broken"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	plugin := handler.(*CustomMetrics)
+	values := make(map[string]float64)
+	for _, metric := range plugin.store.snapshot(false) {
+		values[metric.Labels["status"]] = metric.Value
+	}
+	expected := map[string]float64{"429": 1, "502": 2}
+	if len(values) != len(expected) {
+		t.Errorf("expected only the selected statuses to be recorded, got %v", values)
+	}
+	for status, value := range expected {
+		if values[status] != value {
+			t.Errorf("status %s: expected %v, got %v", status, value, values[status])
+		}
+	}
+}
+
+func TestInvalidStatusCodeFilter(t *testing.T) {
+	for _, value := range []string{"6xx", "0xx", "5x", "abc", "99", "600"} {
+		if _, err := parseStatusFilter([]string{value}); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+	if filter, err := parseStatusFilter([]string{"2XX"}); err != nil || !filter.match(204) || filter.match(301) {
+		t.Errorf("expected 2XX to select the 2xx class, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package custommetrics
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Logger receives the diagnostics of the plugin, such as errors of the metrics server and of
+// the exporters, which happen in the background and cannot be returned to a caller.
+type Logger interface {
+	Errorf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// stderrLogger is the default Logger, writing to standard error where Traefik picks up plugin output.
+type stderrLogger struct {
+	logger *log.Logger
+}
+
+// Errorf logs an error.
+func (l stderrLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Printf("ERROR "+format, args...)
+}
+
+// Infof logs an informational message.
+func (l stderrLogger) Infof(format string, args ...interface{}) {
+	l.logger.Printf("INFO "+format, args...)
+}
+
+// nopLogger discards every message.
+type nopLogger struct{}
+
+// Errorf discards an error.
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// Infof discards an informational message.
+func (nopLogger) Infof(string, ...interface{}) {}
+
+// The logger of every plugin instance, as metrics servers are shared between instances.
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = stderrLogger{logger: log.New(os.Stderr, "custommetrics: ", log.LstdFlags)}
+)
+
+// SetLogger routes the diagnostics of every plugin instance to l. A nil Logger silences them.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// currentLogger returns the Logger set with SetLogger.
+func currentLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// errorLogWriter adapts the Logger to the *log.Logger the standard library reports
+// errors to, such as failed TLS handshakes on the metrics server.
+type errorLogWriter struct{}
+
+// Write logs one message as an error.
+func (errorLogWriter) Write(p []byte) (int, error) {
+	currentLogger().Errorf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// logErrorf logs an error through the current Logger.
+func logErrorf(format string, args ...interface{}) {
+	currentLogger().Errorf(format, args...)
+}
+
+// logInfof logs an informational message through the current Logger.
+func logInfof(format string, args ...interface{}) {
+	currentLogger().Infof(format, args...)
+}
@@ -0,0 +1,80 @@
+package custommetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturingLogger sends the messages it receives to a channel, dropping them when it is full.
+type capturingLogger struct {
+	messages chan string
+}
+
+func (l capturingLogger) Errorf(format string, args ...interface{}) {
+	l.capture("error: " + fmt.Sprintf(format, args...))
+}
+
+func (l capturingLogger) Infof(format string, args ...interface{}) {
+	l.capture("info: " + fmt.Sprintf(format, args...))
+}
+
+func (l capturingLogger) capture(message string) {
+	select {
+	case l.messages <- message:
+	default:
+	}
+}
+
+func TestLoggerReceivesServerError(t *testing.T) {
+	previous := currentLogger()
+	defer SetLogger(previous)
+
+	captured := capturingLogger{messages: make(chan string, 10)}
+	SetLogger(captured)
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "logger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	// Closing the listener under the server makes it fail
+	if err := plugin.server.listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-captured.messages:
+			if strings.HasPrefix(message, "error: Metrics server error:") {
+				return
+			}
+		case <-deadline:
+			t.Fatal("expected the logger to receive the server error")
+		}
+	}
+}
+
+func TestSetNilLoggerSilences(t *testing.T) {
+	previous := currentLogger()
+	defer SetLogger(previous)
+
+	SetLogger(nil)
+	if _, ok := currentLogger().(nopLogger); !ok {
+		t.Errorf("expected a nil logger to discard messages, got %T", currentLogger())
+	}
+	logErrorf("discarded %d", 1)
+}
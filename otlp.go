@@ -0,0 +1,259 @@
+package custommetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultOTLPInterval is the default interval between OTLP exports.
+const DefaultOTLPInterval = 30 * time.Second
+
+// otlpTimeout bounds a single OTLP export request.
+const otlpTimeout = 10 * time.Second
+
+// otlpScopeName is the instrumentation scope of the exported metrics.
+const otlpScopeName = "github.com/zalbiraw/custommetrics"
+
+// otlpCumulative is the OTLP AGGREGATION_TEMPORALITY_CUMULATIVE enum value.
+const otlpCumulative = 2
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// otlpExporter periodically pushes the series of a plugin instance to an OTLP/HTTP receiver,
+// encoded as an ExportMetricsServiceRequest protobuf message.
+type otlpExporter struct {
+	endpoint string
+	interval time.Duration
+	client   *http.Client
+	stopped  chan struct{}
+}
+
+// runOTLPExporter exports on every interval until the plugin is stopped, then exports a last time
+// so the final values are not lost.
+func (c *CustomMetrics) runOTLPExporter() {
+	defer close(c.otlp.stopped)
+
+	ticker := time.NewTicker(c.otlp.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.exportOTLP()
+		case <-c.serverStop:
+			c.exportOTLP()
+			return
+		}
+	}
+}
+
+// exportOTLP sends the current series to the OTLP receiver. Failures are logged and the
+// series are sent again on the next export, as they are cumulative.
+func (c *CustomMetrics) exportOTLP() {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+
+	body := encodeOTLPRequest(c.store, c.now())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.otlp.endpoint, bytes.NewReader(body))
+	if err != nil {
+		logErrorf("OTLP export error: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := c.otlp.client.Do(req)
+	if err != nil {
+		logErrorf("OTLP export error: %v", err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logErrorf("OTLP export error: receiver answered %s", resp.Status)
+	}
+}
+
+// encodeOTLPRequest encodes the series of a store as an ExportMetricsServiceRequest.
+// Counters become monotonic cumulative sums, gauges gauges, histograms cumulative
+// histograms and summaries summaries. Labels become string attributes. Each data point starts
+// when its series was created or last zeroed, so receivers see evicted and reset series restart.
+func encodeOTLPRequest(store *MetricsStore, now time.Time) []byte {
+	names, families := gatherFamilies([]*MetricsStore{store}, false)
+
+	// InstrumentationScope: name = 1
+	scopeMetrics := appendBytesField(nil, 1, appendStringField(nil, 1, otlpScopeName))
+	for _, name := range names {
+		scopeMetrics = appendBytesField(scopeMetrics, 2, encodeOTLPMetric(name, families[name], now))
+	}
+
+	// ResourceMetrics: scope_metrics = 2
+	resourceMetrics := appendBytesField(nil, 2, scopeMetrics)
+
+	// ExportMetricsServiceRequest: resource_metrics = 1
+	return appendBytesField(nil, 1, resourceMetrics)
+}
+
+// encodeOTLPMetric encodes a metric family as an OTLP Metric message.
+func encodeOTLPMetric(name string, series []*Metric, now time.Time) []byte {
+	metric := appendStringField(nil, 1, name)
+
+	var data []byte
+	switch series[0].Type {
+	case MetricTypeCounter:
+		// Sum: data_points = 1, aggregation_temporality = 2, is_monotonic = 3
+		for _, s := range series {
+			data = appendBytesField(data, 1, encodeNumberDataPoint(s, now))
+		}
+		data = appendVarintField(data, 2, otlpCumulative)
+		data = appendVarintField(data, 3, 1)
+		metric = appendBytesField(metric, 7, data)
+	case MetricTypeGauge:
+		// Gauge: data_points = 1
+		for _, s := range series {
+			data = appendBytesField(data, 1, encodeNumberDataPoint(s, now))
+		}
+		metric = appendBytesField(metric, 5, data)
+	case MetricTypeHistogram:
+		// Histogram: data_points = 1, aggregation_temporality = 2
+		for _, s := range series {
+			data = appendBytesField(data, 1, encodeHistogramDataPoint(s, now))
+		}
+		data = appendVarintField(data, 2, otlpCumulative)
+		metric = appendBytesField(metric, 9, data)
+	case MetricTypeSummary:
+		// Summary: data_points = 1
+		for _, s := range series {
+			data = appendBytesField(data, 1, encodeSummaryDataPoint(s, now))
+		}
+		metric = appendBytesField(metric, 11, data)
+	}
+	return metric
+}
+
+// encodeNumberDataPoint encodes a counter or gauge series as a NumberDataPoint.
+func encodeNumberDataPoint(metric *Metric, now time.Time) []byte {
+	point := appendFixed64Field(nil, 2, uint64(metric.startedAt.UnixNano()))
+	point = appendFixed64Field(point, 3, uint64(now.UnixNano()))
+	point = appendDoubleField(point, 4, metric.Value)
+	return appendAttributes(point, 7, metric.Labels)
+}
+
+// encodeHistogramDataPoint encodes a histogram series as a HistogramDataPoint.
+// OTLP counts each bucket separately rather than cumulatively, with a last bucket above the highest bound.
+func encodeHistogramDataPoint(metric *Metric, now time.Time) []byte {
+	bucketCounts := make([]uint64, 0, len(metric.BucketCounts)+1)
+	var previous uint64
+	for _, cumulative := range metric.BucketCounts {
+		bucketCounts = append(bucketCounts, cumulative-previous)
+		previous = cumulative
+	}
+	bucketCounts = append(bucketCounts, metric.Count-previous)
+
+	point := appendFixed64Field(nil, 2, uint64(metric.startedAt.UnixNano()))
+	point = appendFixed64Field(point, 3, uint64(now.UnixNano()))
+	point = appendFixed64Field(point, 4, metric.Count)
+	point = appendDoubleField(point, 5, metric.Sum)
+	point = appendPackedFixed64Field(point, 6, bucketCounts)
+	point = appendPackedDoubleField(point, 7, metric.Buckets)
+	return appendAttributes(point, 9, metric.Labels)
+}
+
+// encodeSummaryDataPoint encodes a summary series as a SummaryDataPoint.
+func encodeSummaryDataPoint(metric *Metric, now time.Time) []byte {
+	point := appendFixed64Field(nil, 2, uint64(metric.startedAt.UnixNano()))
+	point = appendFixed64Field(point, 3, uint64(now.UnixNano()))
+	point = appendFixed64Field(point, 4, metric.Count)
+	point = appendDoubleField(point, 5, metric.Sum)
+	if metric.summary != nil {
+		for i, value := range metric.summary.query(metric.quantiles) {
+			// ValueAtQuantile: quantile = 1, value = 2
+			quantile := appendDoubleField(nil, 1, metric.quantiles[i])
+			quantile = appendDoubleField(quantile, 2, value)
+			point = appendBytesField(point, 6, quantile)
+		}
+	}
+	return appendAttributes(point, 7, metric.Labels)
+}
+
+// appendAttributes appends labels sorted by name as repeated KeyValue fields with string values.
+func appendAttributes(buf []byte, field int, labels map[string]string) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// KeyValue: key = 1, value = 2; AnyValue: string_value = 1
+		keyValue := appendStringField(nil, 1, name)
+		keyValue = appendBytesField(keyValue, 2, appendStringField(nil, 1, labels[name]))
+		buf = appendBytesField(buf, field, keyValue)
+	}
+	return buf
+}
+
+// appendTag appends the key of a protobuf field.
+func appendTag(buf []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+// appendVarintField appends a varint encoded field.
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	buf = appendTag(buf, field, wireVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+// appendBytesField appends a length-delimited field, such as an embedded message.
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendStringField appends a string field.
+func appendStringField(buf []byte, field int, value string) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendFixed64Field appends a fixed64 field.
+func appendFixed64Field(buf []byte, field int, value uint64) []byte {
+	buf = appendTag(buf, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(buf, value)
+}
+
+// appendDoubleField appends a double field.
+func appendDoubleField(buf []byte, field int, value float64) []byte {
+	return appendFixed64Field(buf, field, math.Float64bits(value))
+}
+
+// appendPackedFixed64Field appends a packed repeated fixed64 field.
+func appendPackedFixed64Field(buf []byte, field int, values []uint64) []byte {
+	packed := make([]byte, 0, 8*len(values))
+	for _, value := range values {
+		packed = binary.LittleEndian.AppendUint64(packed, value)
+	}
+	return appendBytesField(buf, field, packed)
+}
+
+// appendPackedDoubleField appends a packed repeated double field.
+func appendPackedDoubleField(buf []byte, field int, values []float64) []byte {
+	packed := make([]byte, 0, 8*len(values))
+	for _, value := range values {
+		packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(value))
+	}
+	return appendBytesField(buf, field, packed)
+}
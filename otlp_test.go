@@ -0,0 +1,268 @@
+package custommetrics
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protoField is a decoded protobuf field.
+type protoField struct {
+	number int
+	fixed  uint64 // Varint and fixed64 values
+	bytes  []byte // Length-delimited values
+}
+
+// decodeProto decodes the top-level fields of a protobuf message.
+func decodeProto(t *testing.T, data []byte) []protoField {
+	t.Helper()
+
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("invalid field key")
+		}
+		data = data[n:]
+
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			field.fixed, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			field.fixed = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatal("invalid length")
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoFields returns the fields with the given number.
+func protoFields(fields []protoField, number int) []protoField {
+	var matching []protoField
+	for _, field := range fields {
+		if field.number == number {
+			matching = append(matching, field)
+		}
+	}
+	return matching
+}
+
+// otlpAttributes decodes the KeyValue attributes with the given field number.
+func otlpAttributes(t *testing.T, point []protoField, number int) map[string]string {
+	t.Helper()
+
+	attributes := make(map[string]string)
+	for _, keyValue := range protoFields(point, number) {
+		fields := decodeProto(t, keyValue.bytes)
+		value := decodeProto(t, protoFields(fields, 2)[0].bytes)
+		attributes[string(protoFields(fields, 1)[0].bytes)] = string(protoFields(value, 1)[0].bytes)
+	}
+	return attributes
+}
+
+func TestOTLPExport(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected export %s %s with content type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.DisableServer = true
+	cfg.OTLPEndpoint = receiver.URL + "/v1/metrics"
+	cfg.OTLPInterval = "1h"
+	cfg.HistogramBuckets = []float64{1, 10}
+	cfg.Metrics = []MetricDefinition{
+		{Name: "otlp_requests", Type: "counter", Headers: []string{"X-Tenant"}},
+		{Name: "otlp_queue_depth", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+		{Name: "otlp_latency", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "otlp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"5", "20"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Value", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Stopping exports the final values
+	if err := handler.(*CustomMetrics).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 export, got %d", len(bodies))
+	}
+
+	resourceMetrics := decodeProto(t, protoFields(decodeProto(t, bodies[0]), 1)[0].bytes)
+	scopeMetrics := decodeProto(t, protoFields(resourceMetrics, 2)[0].bytes)
+	metrics := make(map[string][]protoField)
+	for _, field := range protoFields(scopeMetrics, 2) {
+		metric := decodeProto(t, field.bytes)
+		metrics[string(protoFields(metric, 1)[0].bytes)] = metric
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(metrics))
+	}
+
+	// Counters are monotonic cumulative sums
+	sum := decodeProto(t, protoFields(metrics["otlp_requests"], 7)[0].bytes)
+	if temporality := protoFields(sum, 2)[0].fixed; temporality != otlpCumulative || protoFields(sum, 3)[0].fixed != 1 {
+		t.Errorf("expected a monotonic cumulative sum, got temporality %d", temporality)
+	}
+	point := decodeProto(t, protoFields(sum, 1)[0].bytes)
+	if value := math.Float64frombits(protoFields(point, 4)[0].fixed); value != 2 {
+		t.Errorf("expected counter value 2, got %v", value)
+	}
+	if attributes := otlpAttributes(t, point, 7); len(attributes) != 1 || attributes["x_tenant"] != "acme" {
+		t.Errorf("expected the x_tenant attribute, got %v", attributes)
+	}
+
+	// Gauges keep their last value
+	gauge := decodeProto(t, protoFields(metrics["otlp_queue_depth"], 5)[0].bytes)
+	point = decodeProto(t, protoFields(gauge, 1)[0].bytes)
+	if value := math.Float64frombits(protoFields(point, 4)[0].fixed); value != 20 {
+		t.Errorf("expected gauge value 20, got %v", value)
+	}
+
+	// Histograms count each bucket separately, with a bucket above the highest bound
+	histogram := decodeProto(t, protoFields(metrics["otlp_latency"], 9)[0].bytes)
+	point = decodeProto(t, protoFields(histogram, 1)[0].bytes)
+	if count := protoFields(point, 4)[0].fixed; count != 2 {
+		t.Errorf("expected histogram count 2, got %d", count)
+	}
+	if sum := math.Float64frombits(protoFields(point, 5)[0].fixed); sum != 25 {
+		t.Errorf("expected histogram sum 25, got %v", sum)
+	}
+	packed := protoFields(point, 6)[0].bytes
+	var bucketCounts []uint64
+	for i := 0; i < len(packed); i += 8 {
+		bucketCounts = append(bucketCounts, binary.LittleEndian.Uint64(packed[i:]))
+	}
+	if len(bucketCounts) != 3 || bucketCounts[0] != 0 || bucketCounts[1] != 1 || bucketCounts[2] != 1 {
+		t.Errorf("expected bucket counts [0 1 1], got %v", bucketCounts)
+	}
+	if attributes := otlpAttributes(t, point, 9); attributes["x_tenant"] != "acme" {
+		t.Errorf("expected the x_tenant attribute, got %v", attributes)
+	}
+}
+
+func TestInvalidOTLPConfig(t *testing.T) {
+	tests := map[string]func(*Config){
+		"endpoint scheme": func(cfg *Config) { cfg.OTLPEndpoint = "otel-collector:4318" },
+		"interval":        func(cfg *Config) { cfg.OTLPEndpoint = "http://localhost:4318/v1/metrics"; cfg.OTLPInterval = "often" },
+		"zero interval":   func(cfg *Config) { cfg.OTLPEndpoint = "http://localhost:4318/v1/metrics"; cfg.OTLPInterval = "0s" },
+	}
+
+	for name, configure := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-otlp-test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestOTLPSeriesStartTimes(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.DisableServer = true
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "otlp_start"
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "otlp-start-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Inject a fake clock
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	plugin.now = func() time.Time { return clock }
+
+	send := func(tenant string) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	startTimes := func() map[string]time.Time {
+		resourceMetrics := decodeProto(t, protoFields(decodeProto(t, encodeOTLPRequest(plugin.store, clock)), 1)[0].bytes)
+		scopeMetrics := decodeProto(t, protoFields(resourceMetrics, 2)[0].bytes)
+		metric := decodeProto(t, protoFields(scopeMetrics, 2)[0].bytes)
+		sum := decodeProto(t, protoFields(metric, 7)[0].bytes)
+
+		starts := make(map[string]time.Time)
+		for _, field := range protoFields(sum, 1) {
+			point := decodeProto(t, field.bytes)
+			starts[otlpAttributes(t, point, 7)["x_tenant"]] = time.Unix(0, int64(protoFields(point, 2)[0].fixed)).UTC()
+		}
+		return starts
+	}
+
+	created := clock
+	send("acme")
+	clock = clock.Add(time.Hour)
+	send("globex")
+	if starts := startTimes(); !starts["acme"].Equal(created) || !starts["globex"].Equal(clock) {
+		t.Errorf("expected each series to start when it was created, got %v", starts)
+	}
+
+	// Zeroed series start again
+	clock = clock.Add(time.Hour)
+	plugin.store.zero(clock)
+	if starts := startTimes(); !starts["acme"].Equal(clock) || !starts["globex"].Equal(clock) {
+		t.Errorf("expected zeroed series to start at the reset, got %v", starts)
+	}
+}
@@ -0,0 +1,81 @@
+package custommetrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultPathOtherValue is the path label value used for paths matching no template.
+const DefaultPathOtherValue = "other"
+
+// pathTemplate is a parsed path template such as "/users/{id}" or "/users/:id".
+type pathTemplate struct {
+	template string
+	segments []string
+}
+
+// parsePathTemplate parses a path template. Segments wrapped in braces or starting with a colon
+// match any single path segment.
+func parsePathTemplate(template string) (pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return pathTemplate{}, fmt.Errorf("path template %q must start with /", template)
+	}
+
+	return pathTemplate{
+		template: template,
+		segments: strings.Split(strings.Trim(template, "/"), "/"),
+	}, nil
+}
+
+// isWildcard reports whether a template segment matches any path segment.
+func isWildcard(segment string) bool {
+	if len(segment) > 1 && segment[0] == ':' {
+		return true
+	}
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// match reports whether the path matches the template segment by segment.
+// It walks the path in place to avoid allocating on the request path.
+func (t pathTemplate) match(path string) bool {
+	rest := strings.Trim(path, "/")
+	for i, segment := range t.segments {
+		current := rest
+		if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+			current, rest = rest[:slash], rest[slash+1:]
+		} else if i < len(t.segments)-1 {
+			return false // Path has fewer segments than the template
+		} else {
+			rest = ""
+		}
+
+		if isWildcard(segment) {
+			if current == "" {
+				return false
+			}
+		} else if segment != current {
+			return false
+		}
+	}
+	return rest == ""
+}
+
+// resolvePath returns the path label value for a request path.
+//
+// Matching precedence:
+//  1. Without templates, the raw request path is used as is.
+//  2. Otherwise templates are tried in configured order and the first match wins,
+//     so more specific templates should be listed before more generic ones.
+//  3. Paths matching no template collapse to the configured other value.
+func (c *CustomMetrics) resolvePath(path string) string {
+	if len(c.pathTemplates) == 0 {
+		return path
+	}
+
+	for _, template := range c.pathTemplates {
+		if template.match(path) {
+			return template.template
+		}
+	}
+	return c.pathOtherValue
+}
@@ -0,0 +1,60 @@
+package custommetrics
+
+import "testing"
+
+func TestPathTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		expected bool
+	}{
+		{template: "/", path: "/", expected: true},
+		{template: "/", path: "/users", expected: false},
+		{template: "/users", path: "/users", expected: true},
+		{template: "/users", path: "/users/", expected: true},
+		{template: "/users/{id}", path: "/users/123", expected: true},
+		{template: "/users/{id}", path: "/users", expected: false},
+		{template: "/users/{id}", path: "/users/123/orders", expected: false},
+		{template: "/users/{id}/orders/{order}", path: "/users/1/orders/2", expected: true},
+		{template: "/users/{id}/orders/{order}", path: "/users/1/items/2", expected: false},
+		{template: "/users/:id/orders/:id", path: "/users/123/orders/456", expected: true},
+		{template: "/users/:id/orders/:id", path: "/users/123/orders", expected: false},
+		{template: "/users/:", path: "/users/123", expected: false},
+	}
+
+	for _, test := range tests {
+		template, err := parsePathTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := template.match(test.path); matched != test.expected {
+			t.Errorf("%s matching %s: expected %v, got %v", test.template, test.path, test.expected, matched)
+		}
+	}
+}
+
+func TestInvalidPathTemplate(t *testing.T) {
+	if _, err := parsePathTemplate("users/{id}"); err == nil {
+		t.Error("expected error for a path template without a leading slash")
+	}
+}
+
+func TestResolvePathDoesNotAllocate(t *testing.T) {
+	plugin := &CustomMetrics{pathOtherValue: DefaultPathOtherValue}
+	for _, raw := range []string{"/users/:id", "/users/:id/orders/:id"} {
+		template, err := parsePathTemplate(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin.pathTemplates = append(plugin.pathTemplates, template)
+	}
+
+	for _, path := range []string{"/users/123/orders/456", "/unknown/path"} {
+		allocs := testing.AllocsPerRun(100, func() {
+			plugin.resolvePath(path)
+		})
+		if allocs != 0 {
+			t.Errorf("resolving %s: expected no allocations, got %v", path, allocs)
+		}
+	}
+}
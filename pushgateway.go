@@ -0,0 +1,124 @@
+package custommetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultPushInterval is the default interval between pushes to a Pushgateway.
+const DefaultPushInterval = 30 * time.Second
+
+// DefaultPushgatewayJob is the default job label of pushed metrics.
+const DefaultPushgatewayJob = "traefik"
+
+// maxPushBackoff caps how long pushes are delayed after consecutive failures.
+const maxPushBackoff = 5 * time.Minute
+
+// pushTimeout bounds a single push request.
+const pushTimeout = 10 * time.Second
+
+// pushgatewayPusher periodically replaces the metrics of a plugin instance in a Pushgateway
+// grouping with the current exposition.
+type pushgatewayPusher struct {
+	url      string // Grouping URL, ending in /metrics/job/<job>/instance/<name>
+	interval time.Duration
+	client   *http.Client
+	stopped  chan struct{}
+}
+
+// pushgatewayGroupingURL returns the URL of the grouping for the job and instance labels.
+func pushgatewayGroupingURL(baseURL, job, instance string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/metrics" +
+		pushgatewayLabelPath("job", job) + pushgatewayLabelPath("instance", instance)
+}
+
+// pushgatewayLabelPath encodes a grouping label as path segments. Values containing slashes,
+// or empty ones, use the base64 encoding the Pushgateway supports for them.
+func pushgatewayLabelPath(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// runPushgatewayPusher pushes on every interval until the plugin is stopped, then pushes a last
+// time so the final values are not lost. Consecutive failures back the pushes off exponentially.
+func (c *CustomMetrics) runPushgatewayPusher() {
+	defer close(c.pushgateway.stopped)
+
+	var failures int
+	timer := time.NewTimer(c.pushgateway.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if err := c.pushToGateway(); err != nil {
+				failures++
+				delay := pushBackoff(c.pushgateway.interval, failures)
+				logErrorf("Pushgateway push error (attempt %d, retrying in %s): %v", failures, delay, err)
+				timer.Reset(delay)
+				continue
+			}
+			failures = 0
+			timer.Reset(c.pushgateway.interval)
+		case <-c.serverStop:
+			if err := c.pushToGateway(); err != nil {
+				logErrorf("Pushgateway push error: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// pushBackoff returns the delay before the next push after consecutive failures:
+// the interval doubled per failure, at most maxPushBackoff.
+func pushBackoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPushBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPushBackoff {
+		delay = maxPushBackoff
+	}
+	return delay
+}
+
+// pushToGateway replaces the metrics of the grouping with the current exposition.
+func (c *CustomMetrics) pushToGateway() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	// The Pushgateway only accepts the classic text format
+	options := c.serverOptions
+	options.format = ExpositionFormatPrometheus
+	var body bytes.Buffer
+	if err := writeStores(&body, []*MetricsStore{c.store}, options, false); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.pushgateway.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", prometheusContentType)
+
+	resp, err := c.pushgateway.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushgateway answered %s", resp.Status)
+	}
+	return nil
+}
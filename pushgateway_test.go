@@ -0,0 +1,154 @@
+package custommetrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushgatewayGroupingURL(t *testing.T) {
+	tests := []struct {
+		baseURL, job, instance string
+		expected               string
+	}{
+		{"http://pushgateway:9091", "traefik", "my-plugin", "http://pushgateway:9091/metrics/job/traefik/instance/my-plugin"},
+		{"http://pushgateway:9091/", "traefik", "my plugin", "http://pushgateway:9091/metrics/job/traefik/instance/my%20plugin"},
+		{"http://pushgateway:9091", "traefik", "routers/api", "http://pushgateway:9091/metrics/job/traefik/instance@base64/cm91dGVycy9hcGk"},
+	}
+
+	for _, test := range tests {
+		if groupingURL := pushgatewayGroupingURL(test.baseURL, test.job, test.instance); groupingURL != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, groupingURL)
+		}
+	}
+}
+
+func TestPushBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: 20 * time.Second},
+		{failures: 2, expected: 40 * time.Second},
+		{failures: 5, expected: maxPushBackoff},
+		{failures: 100, expected: maxPushBackoff},
+	}
+
+	for _, test := range tests {
+		if delay := pushBackoff(10*time.Second, test.failures); delay != test.expected {
+			t.Errorf("%d failures: expected %s, got %s", test.failures, test.expected, delay)
+		}
+	}
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	var mu sync.Mutex
+	pushes := make(chan string, 10)
+	var failed bool
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/batch/instance/pushgateway-test" {
+			t.Errorf("unexpected push %s %s", r.Method, r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		// The first push fails and is retried
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		pushes <- string(body)
+	}))
+	defer gateway.Close()
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "pushed_requests"
+	cfg.DisableServer = true
+	cfg.PushgatewayURL = gateway.URL
+	cfg.PushgatewayJob = "batch"
+	cfg.PushInterval = "10ms"
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "pushgateway-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = handler.(*CustomMetrics).Stop() }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case body := <-pushes:
+		if !strings.Contains(body, `pushed_requests_total{x_user_id="user123"} 1`+"\n") {
+			t.Errorf("expected the pushed exposition to contain the series, got:\n%s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a push to succeed")
+	}
+}
+
+func TestPushgatewayStop(t *testing.T) {
+	pushes := make(chan string, 10)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		pushes <- string(body)
+	}))
+	defer gateway.Close()
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.PushgatewayURL = gateway.URL
+	cfg.PushInterval = "1h"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "pushgateway-stop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping pushes a last time and waits for it
+	if err := handler.(*CustomMetrics).Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushes) != 1 {
+		t.Errorf("expected 1 push on stop, got %d", len(pushes))
+	}
+}
+
+func TestInvalidPushgatewayConfig(t *testing.T) {
+	tests := map[string]func(*Config){
+		"url":           func(cfg *Config) { cfg.PushgatewayURL = "pushgateway:9091" },
+		"interval":      func(cfg *Config) { cfg.PushgatewayURL = "http://localhost:9091"; cfg.PushInterval = "often" },
+		"zero interval": func(cfg *Config) { cfg.PushgatewayURL = "http://localhost:9091"; cfg.PushInterval = "0s" },
+	}
+
+	for name, configure := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-pushgateway-test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package custommetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long a metrics server waits for in-flight scrapes when shutting down.
+const shutdownTimeout = 5 * time.Second
+
+// sharedServer is a metrics HTTP server shared by every plugin instance
+// configured with the same port. It renders the union of their metrics.
+type sharedServer struct {
+	port          int
+	options       serverOptions
+	handler       http.Handler
+	server        *http.Server
+	listener      net.Listener
+	actualPort    int // Port the listener is bound to, chosen by the system for port 0
+	serverStopped chan struct{}
+
+	mu        sync.RWMutex
+	instances []*CustomMetrics
+}
+
+// resetPath is the path of the endpoint deleting every collected series, when enabled.
+const resetPath = "/reset"
+
+// Paths of the liveness and readiness probes, which answer without credentials.
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// Reset modes, chosen with the mode query parameter of the reset endpoint.
+const (
+	resetModeClear = "clear" // resetModeClear deletes every series.
+	resetModeZero  = "zero"  // resetModeZero resets the values of every series, keeping the series.
+)
+
+// resetResult is the JSON body answering a reset.
+type resetResult struct {
+	Mode   string `json:"mode"`
+	Series int    `json:"series"` // Number of series deleted or zeroed
+}
+
+// serverOptions configure a metrics server. Instances sharing a port must agree on them.
+type serverOptions struct {
+	address string
+	path    string
+	format  string
+
+	appendTotalSuffix bool
+	authToken         string
+	basicAuth         BasicAuth
+	allowedNetworks   []*net.IPNet
+	renderCacheTTL    time.Duration
+	enableReset       bool
+
+	// Serves HTTPS when set. Instances sharing a port are compared by the files, not the loaded certificate.
+	tlsFiles    TLSCertificate
+	certificate *tls.Certificate
+}
+
+// conflict returns an error describing the first option that differs between two configurations.
+func (o serverOptions) conflict(port int, other serverOptions) error {
+	switch {
+	case o.address != other.address:
+		return fmt.Errorf("metrics server on port %d is already bound to %q, cannot also bind to %q", port, o.address, other.address)
+	case o.path != other.path:
+		return fmt.Errorf("metrics server on port %d already serves %s, cannot also serve %s", port, o.path, other.path)
+	case o.format != other.format:
+		return fmt.Errorf("metrics server on port %d already uses the %s format, cannot also use %s", port, o.format, other.format)
+	case o.appendTotalSuffix != other.appendTotalSuffix:
+		return fmt.Errorf("metrics server on port %d already has appendTotalSuffix=%t, cannot also use %t", port, o.appendTotalSuffix, other.appendTotalSuffix)
+	case o.authToken != other.authToken:
+		// Never include the tokens themselves in the error
+		return fmt.Errorf("metrics server on port %d already uses a different metricsAuthToken", port)
+	case o.basicAuth != other.basicAuth:
+		return fmt.Errorf("metrics server on port %d already uses different metricsAuth credentials", port)
+	case !sameNetworks(o.allowedNetworks, other.allowedNetworks):
+		return fmt.Errorf("metrics server on port %d already allows %s, cannot also allow %s", port, formatNetworks(o.allowedNetworks), formatNetworks(other.allowedNetworks))
+	case o.renderCacheTTL != other.renderCacheTTL:
+		return fmt.Errorf("metrics server on port %d already has renderCacheTTL=%s, cannot also use %s", port, o.renderCacheTTL, other.renderCacheTTL)
+	case o.enableReset != other.enableReset:
+		return fmt.Errorf("metrics server on port %d already has enableReset=%t, cannot also use %t", port, o.enableReset, other.enableReset)
+	case o.tlsFiles != other.tlsFiles:
+		return fmt.Errorf("metrics server on port %d already uses a different metricsTLS certificate", port)
+	}
+	return nil
+}
+
+// sameNetworks reports whether two lists hold the same networks in the same order.
+func sameNetworks(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// formatNetworks describes the networks allowed to scrape for error messages.
+func formatNetworks(networks []*net.IPNet) string {
+	if len(networks) == 0 {
+		return "all clients"
+	}
+	cidrs := make([]string, 0, len(networks))
+	for _, network := range networks {
+		cidrs = append(cidrs, network.String())
+	}
+	return strings.Join(cidrs, ", ")
+}
+
+// Registry of running metrics servers keyed by port.
+var (
+	serversMu sync.Mutex
+	servers   = make(map[int]*sharedServer)
+)
+
+// ErrPortInUse is reported by New when another process already listens on the metrics port.
+// The error also wraps the *net.OpError returned by the listener.
+var ErrPortInUse = errors.New("metrics port is already in use")
+
+// portInUseError is the error returned when listening on an occupied metrics port.
+type portInUseError struct {
+	port int
+	err  error
+}
+
+// Error describes the occupied port and the listener error.
+func (e *portInUseError) Error() string {
+	return fmt.Sprintf("port %d is already in use: %v", e.port, e.err)
+}
+
+// Unwrap returns the listener error.
+func (e *portInUseError) Unwrap() error {
+	return e.err
+}
+
+// Is matches ErrPortInUse.
+func (e *portInUseError) Is(target error) bool {
+	return target == ErrPortInUse
+}
+
+// isAddrInUse reports whether a listener error is caused by another socket holding the address.
+// Yaegi does not let plugins import syscall, so the system error is recognized by its message.
+func isAddrInUse(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "listen" || opErr.Err == nil {
+		return false
+	}
+	message := strings.ToLower(opErr.Err.Error())
+	return strings.Contains(message, "address already in use") || // Unix
+		strings.Contains(message, "only one usage of each socket address") // Windows
+}
+
+// startMetricsServer attaches the plugin to the metrics server for its port,
+// starting the server if no other instance is using that port yet.
+func (c *CustomMetrics) startMetricsServer() error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	// Port 0 picks a random port, so such servers are never shared
+	if c.metricsPort != 0 {
+		if shared, ok := servers[c.metricsPort]; ok {
+			if err := shared.options.conflict(c.metricsPort, c.serverOptions); err != nil {
+				return err
+			}
+			shared.attach(c)
+			c.server = shared
+			return nil
+		}
+	}
+
+	shared, err := newSharedServer(c.metricsPort, c.serverOptions)
+	if err != nil && c.portFallback && errors.Is(err, ErrPortInUse) {
+		// A server on a random port is not shared, so each falling back instance gets its own
+		shared, err = newSharedServer(0, c.serverOptions)
+		if err == nil {
+			logErrorf("Metrics port %d is already in use, serving the metrics of %s on port %d instead", c.metricsPort, c.name, shared.actualPort)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	shared.attach(c)
+	c.server = shared
+
+	if shared.port != 0 {
+		servers[shared.port] = shared
+	}
+
+	return nil
+}
+
+// newSharedServer starts a metrics HTTP server with port conflict detection.
+func newSharedServer(port int, options serverOptions) (*sharedServer, error) {
+	addr := net.JoinHostPort(options.address, strconv.Itoa(port))
+
+	// Check if port is available (port 0 means random available port)
+	listener, err := net.Listen("tcp", addr)
+	if isAddrInUse(err) {
+		return nil, &portInUseError{port: port, err: err}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on port %d: %w", port, err)
+	}
+
+	shared := &sharedServer{
+		port:          port,
+		options:       options,
+		listener:      listener,
+		actualPort:    port,
+		serverStopped: make(chan struct{}),
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		shared.actualPort = addr.Port
+	}
+	shared.handler = newMetricsHandler(shared.stores, shared.ready, options)
+
+	shared.server = &http.Server{
+		Addr:              addr,
+		Handler:           shared.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.New(errorLogWriter{}, "", 0),
+	}
+	if options.certificate != nil {
+		shared.server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*options.certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	logInfof("Metrics server listening on %s", listener.Addr())
+
+	// Start server in background with graceful shutdown
+	go func() {
+		defer close(shared.serverStopped)
+
+		var err error
+		if options.certificate != nil {
+			// The certificate is already in the TLS configuration
+			err = shared.server.ServeTLS(listener, "", "")
+		} else {
+			err = shared.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			// Log error but don't crash the plugin
+			logErrorf("Metrics server error: %v", err)
+		}
+	}()
+
+	return shared, nil
+}
+
+// newMetricsHandler creates the handler serving the metrics endpoints for the stores.
+func newMetricsHandler(stores func() []*MetricsStore, ready func() bool, options serverOptions) http.Handler {
+	serveJSON := func(w http.ResponseWriter, r *http.Request) {
+		body, err := renderJSON(stores())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		_, _ = w.Write(body)
+	}
+
+	// Each exposition format is rendered, and cached, on its own. Without a cache
+	// the exposition is streamed to the response as it is rendered.
+	renders := make(map[string]func(io.Writer) error, 2)
+	for _, format := range []string{ExpositionFormatPrometheus, ExpositionFormatOpenMetrics} {
+		formatOptions := options
+		formatOptions.format = format
+		if options.renderCacheTTL > 0 {
+			cache := newRenderCache(options.renderCacheTTL, func() string {
+				return renderStores(stores(), formatOptions, true)
+			})
+			renders[format] = func(w io.Writer) error {
+				_, err := io.WriteString(w, cache.get())
+				return err
+			}
+			continue
+		}
+		renders[format] = func(w io.Writer) error {
+			return writeStores(w, stores(), formatOptions, true)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(options.path, func(w http.ResponseWriter, r *http.Request) {
+		countScrape(stores())
+		if acceptsMediaType(r, jsonContentType) {
+			serveJSON(w, r)
+			return
+		}
+
+		// Scrapers asking for OpenMetrics get it whatever the configured format
+		format := options.format
+		if acceptsMediaType(r, openMetricsMediaType) {
+			format = ExpositionFormatOpenMetrics
+		}
+
+		if format == ExpositionFormatOpenMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", prometheusContentType)
+		}
+		// The response is already under way, so a failed write is the scraper going away
+		_ = renders[format](w)
+	})
+
+	// Raw series state for debugging, next to the exposition endpoint
+	mux.HandleFunc(options.path+".json", func(w http.ResponseWriter, r *http.Request) {
+		countScrape(stores())
+		serveJSON(w, r)
+	})
+
+	if options.enableReset {
+		mux.HandleFunc(resetPath, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			result := resetResult{Mode: r.URL.Query().Get("mode")}
+			switch result.Mode {
+			case "", resetModeClear:
+				result.Mode = resetModeClear
+				for _, store := range stores() {
+					result.Series += store.clear()
+				}
+			case resetModeZero:
+				now := time.Now()
+				for _, store := range stores() {
+					result.Series += store.zero(now)
+				}
+			default:
+				http.Error(w, fmt.Sprintf("mode must be %s or %s, got %q", resetModeClear, resetModeZero, result.Mode), http.StatusBadRequest)
+				return
+			}
+
+			body, err := json.Marshal(result)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", jsonContentType)
+			_, _ = w.Write(body)
+		})
+	}
+
+	var handler http.Handler = compressResponse(mux)
+	if options.authToken != "" {
+		handler = requireBearerToken(options.authToken, handler)
+	}
+	if options.basicAuth.Username != "" {
+		handler = requireBasicAuth(options.basicAuth, handler)
+	}
+
+	// Probes are answered before credentials are checked, so orchestrators need no secret
+	probes := http.NewServeMux()
+	probes.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+	probes.HandleFunc(readyPath, func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+	probes.Handle("/", handler)
+	handler = probes
+
+	if len(options.allowedNetworks) > 0 {
+		handler = requireAllowedAddress(options.allowedNetworks, handler)
+	}
+	return handler
+}
+
+// countScrape counts a scrape in the internal metrics of each store.
+func countScrape(stores []*MetricsStore) {
+	now := time.Now()
+	for _, store := range stores {
+		store.incrementInternal(scrapesMetricName, now)
+	}
+}
+
+// MetricsHandler returns the handler serving the metrics endpoints, for mounting them on an
+// existing server. While the plugin runs its own metrics server, this is the handler of that
+// server, which also exposes the metrics of the instances sharing its port.
+func (c *CustomMetrics) MetricsHandler() http.Handler {
+	if c.server != nil {
+		return c.server.handler
+	}
+	return c.handler
+}
+
+// ActualPort returns the port the metrics server listens on, which is chosen by the system
+// when MetricsPort is 0 or PortFallback applies. It is 0 when the server is disabled.
+func (c *CustomMetrics) ActualPort() int {
+	if c.server == nil {
+		return 0
+	}
+	return c.server.actualPort
+}
+
+// acceptsMediaType reports whether the request explicitly asks for the media type in its
+// Accept header. Wildcards do not count, and an explicit q=0 refuses the media type.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			params := strings.Split(mediaRange, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+				continue
+			}
+
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "q") {
+					if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// attach registers a plugin instance whose metrics the server exposes.
+func (s *sharedServer) attach(c *CustomMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.instances = append(s.instances, c)
+}
+
+// release detaches a plugin instance and closes the server once the last instance is gone.
+func (s *sharedServer) release(c *CustomMetrics) error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	s.mu.Lock()
+	for i, instance := range s.instances {
+		if instance == c {
+			s.instances = append(s.instances[:i], s.instances[i+1:]...)
+			break
+		}
+	}
+	remaining := len(s.instances)
+	s.mu.Unlock()
+
+	if remaining > 0 {
+		return nil
+	}
+
+	if servers[s.port] == s {
+		delete(servers, s.port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		// Scrapes did not drain in time, force the connections closed
+		err = s.server.Close()
+	}
+	<-s.serverStopped // Wait for server to stop
+	return err
+}
+
+// ready reports whether any attached instance is ready.
+func (s *sharedServer) ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, instance := range s.instances {
+		if instance.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// stores returns the metric stores of all attached instances.
+func (s *sharedServer) stores() []*MetricsStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stores := make([]*MetricsStore, 0, len(s.instances))
+	for _, instance := range s.instances {
+		stores = append(stores, instance.store)
+	}
+	return stores
+}
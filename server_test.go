@@ -0,0 +1,1415 @@
+package custommetrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, port int) string {
+	t.Helper()
+
+	_, body := get(t, fmt.Sprintf("http://localhost:%d/metrics", port))
+	return body
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestSharedServerAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	port := freePort(t)
+	var plugins []*CustomMetrics
+	for _, name := range []string{"shared_first", "shared_second"} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricName = name
+		cfg.MetricsPort = port
+
+		handler, err := New(ctx, next, cfg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+		t.Cleanup(func() { _ = plugin.Stop() })
+		plugins = append(plugins, plugin)
+	}
+
+	output := scrape(t, port)
+	for _, name := range []string{"shared_first", "shared_second"} {
+		if !strings.Contains(output, name+`_total{x_user_id="user123"} 1`) {
+			t.Errorf("expected shared output to contain %s, got:\n%s", name, output)
+		}
+	}
+
+	// Stopping one instance keeps the endpoint up for the other
+	if err := plugins[0].Stop(); err != nil {
+		t.Fatal(err)
+	}
+	output = scrape(t, port)
+	if strings.Contains(output, "shared_first") || !strings.Contains(output, "shared_second") {
+		t.Errorf("expected only the remaining instance's metrics, got:\n%s", output)
+	}
+
+	// Stopping the last instance frees the port
+	if err := plugins[1].Stop(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("expected port to be free after the last instance stopped: %v", err)
+	}
+	_ = listener.Close()
+}
+
+func TestSharedServerConcurrentLifecycle(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	port := freePort(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cfg := CreateConfig()
+			cfg.MetricHeaders = []string{"X-User-ID"}
+			cfg.MetricName = fmt.Sprintf("concurrent_%d", i)
+			cfg.MetricsPort = port
+
+			handler, err := New(context.Background(), next, cfg, "concurrent")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if plugin, ok := handler.(*CustomMetrics); ok {
+				if err := plugin.Stop(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	serversMu.Lock()
+	_, running := servers[port]
+	serversMu.Unlock()
+	if running {
+		t.Error("expected no server to remain registered after all instances stopped")
+	}
+}
+
+func TestContextCancellationStopsServer(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := handler.(*CustomMetrics).ActualPort()
+
+	cancel()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			_ = listener.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected port to become bindable after context cancellation: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCustomMetricsPath(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "custom_path_test"
+	cfg.MetricsPort = 0
+	cfg.MetricsPath = "/internal/prom"
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "custom-path-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	status, body := get(t, fmt.Sprintf("http://localhost:%d/internal/prom", plugin.ActualPort()))
+	if status != http.StatusOK || !strings.Contains(body, `custom_path_test_total{x_user_id="user123"} 1`) {
+		t.Errorf("expected exposition on the custom path, got %d:\n%s", status, body)
+	}
+
+	if status, _ := get(t, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort())); status != http.StatusNotFound {
+		t.Errorf("expected 404 on the default path, got %d", status)
+	}
+}
+
+func TestInvalidMetricsPath(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MetricsPath = "metrics"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	if _, err := New(context.Background(), next, cfg, "invalid-path-test"); err == nil {
+		t.Error("expected error for a metrics path without a leading slash")
+	}
+}
+
+func TestSharedServerPathConflict(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = freePort(t)
+
+	handler, err := New(context.Background(), next, cfg, "path-conflict-first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	cfg.MetricsPath = "/other"
+	if _, err := New(context.Background(), next, cfg, "path-conflict-second"); err == nil {
+		t.Error("expected error when sharing a port with a different metrics path")
+	}
+}
+
+func TestSharedServerMergesIdenticalSeries(t *testing.T) {
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	port := freePort(t)
+
+	// Traefik creates one instance per router using the middleware, all with the same configuration
+	for _, router := range []string{"router-a", "router-b"} {
+		cfg := CreateConfig()
+		cfg.MetricsPort = port
+		cfg.HistogramBuckets = []float64{1}
+		cfg.Metrics = []MetricDefinition{
+			{Name: "merged_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+			{Name: "merged_size", Type: "histogram", Headers: []string{"X-User-ID"}, ValueHeader: "X-Size"},
+		}
+
+		handler, err := New(ctx, next, cfg, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin, ok := handler.(*CustomMetrics)
+		if !ok {
+			t.Fatal("handler is not a CustomMetrics instance")
+		}
+		t.Cleanup(func() { _ = plugin.Stop() })
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Size", "0.5")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	output := scrape(t, port)
+	t.Logf("Prometheus output:\n%s", output)
+
+	expected := []string{
+		`merged_requests_total{x_user_id="user123"} 2` + "\n",
+		`merged_size_bucket{x_user_id="user123",le="1"} 2` + "\n",
+		`merged_size_sum{x_user_id="user123"} 1` + "\n",
+		`merged_size_count{x_user_id="user123"} 2` + "\n",
+	}
+	for _, line := range expected {
+		if strings.Count(output, line) != 1 {
+			t.Errorf("expected output to contain %q exactly once", line)
+		}
+	}
+}
+
+func TestMergeSeriesGaugeKeepsLatest(t *testing.T) {
+	now := time.Now()
+	series := []*Metric{
+		{Name: "gauge", Type: MetricTypeGauge, Value: 1, Labels: map[string]string{"a": "1"}, LastUpdated: now},
+		{Name: "gauge", Type: MetricTypeGauge, Value: 2, Labels: map[string]string{"a": "1"}, LastUpdated: now.Add(time.Second)},
+		{Name: "gauge", Type: MetricTypeGauge, Value: 3, Labels: map[string]string{"a": "1"}, LastUpdated: now.Add(-time.Second)},
+		{Name: "gauge", Type: MetricTypeGauge, Value: 4, Labels: map[string]string{"a": "2"}, LastUpdated: now},
+	}
+
+	merged := mergeSeries(series)
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 merged series, got %d", len(merged))
+	}
+	if merged[0].Value != 2 || merged[1].Value != 4 {
+		t.Errorf("expected merged values 2 and 4, got %v and %v", merged[0].Value, merged[1].Value)
+	}
+}
+
+func TestOpenMetricsContentType(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+	cfg.ExpositionFormat = "openmetrics"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(context.Background(), next, cfg, "openmetrics-content-type-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("expected OpenMetrics content type, got %q", contentType)
+	}
+}
+
+func TestJSONSnapshotEndpoint(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "json_requests_total"
+	cfg.MetricsPort = 0
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(ctx, next, cfg, "json-snapshot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+	port := plugin.ActualPort()
+
+	for _, user := range []string{"carol", "alice", "bob", "alice"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	status, body := get(t, fmt.Sprintf("http://localhost:%d/metrics.json", port))
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	var metrics []*Metric
+	if err := json.Unmarshal([]byte(body), &metrics); err != nil {
+		t.Fatalf("invalid JSON snapshot %q: %v", body, err)
+	}
+
+	expected := []struct {
+		user  string
+		value float64
+	}{{"alice", 2}, {"bob", 1}, {"carol", 1}}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %d series, got %d: %s", len(expected), len(metrics), body)
+	}
+	for i, want := range expected {
+		metric := metrics[i]
+		if metric.Name != "json_requests_total" || metric.Labels["x_user_id"] != want.user || metric.Value != want.value {
+			t.Errorf("series %d: expected %s=%v, got %+v", i, want.user, want.value, metric)
+		}
+	}
+
+	// The snapshot must be stable between reads
+	if _, again := get(t, fmt.Sprintf("http://localhost:%d/metrics.json", port)); again != body {
+		t.Errorf("expected identical snapshots, got %q and %q", body, again)
+	}
+
+	// Prometheus scraping is unaffected
+	if output := scrape(t, port); !strings.Contains(output, `json_requests_total{x_user_id="alice"} 2`) {
+		t.Errorf("expected Prometheus output to be unchanged, got:\n%s", output)
+	}
+}
+
+func TestMetricsAddress(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+	cfg.MetricsAddress = "127.0.0.1"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(context.Background(), next, cfg, "metrics-address-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+	base := fmt.Sprintf("127.0.0.1:%d", plugin.ActualPort())
+
+	if status, _ := get(t, "http://"+base+"/metrics"); status != http.StatusOK {
+		t.Errorf("expected status 200 on the bound address, got %d", status)
+	}
+	if status, _ := get(t, "http://"+base+"/other"); status != http.StatusNotFound {
+		t.Errorf("expected status 404 for other paths, got %d", status)
+	}
+
+	// The server must not be listening on the wildcard address
+	if addr := plugin.server.listener.Addr().String(); addr != base {
+		t.Errorf("expected the server to listen on %s, got %q", base, addr)
+	}
+}
+
+func TestMetricsAddressHostName(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+	cfg.MetricsAddress = "localhost"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "metrics-hostname-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	if status, _ := get(t, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort())); status != http.StatusOK {
+		t.Errorf("expected status 200 on the bound host name, got %d", status)
+	}
+}
+
+func TestInvalidMetricsAddress(t *testing.T) {
+	for _, address := range []string{"localhost:8080", "[::1]:8080", "metrics host", "under_score.example", "-leading.example"} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.MetricsAddress = address
+
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+		if _, err := New(context.Background(), next, cfg, "invalid-address-test"); err == nil {
+			t.Errorf("expected error for metrics address %q", address)
+		}
+	}
+}
+
+func TestMetricsAddressNormalization(t *testing.T) {
+	for address, expected := range map[string]string{
+		"127.0.0.1":       "127.0.0.1",
+		"[::1]":           "::1",
+		"0:0:0:0:0:0:0:1": "::1",
+		"localhost":       "localhost",
+		"Metrics.Local.":  "metrics.local",
+	} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.MetricsAddress = address
+
+		handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "address-normalization-test")
+		if err != nil {
+			t.Fatalf("address %q: %v", address, err)
+		}
+		if normalized := handler.(*CustomMetrics).serverOptions.address; normalized != expected {
+			t.Errorf("expected %q to bind %q, got %q", address, expected, normalized)
+		}
+	}
+}
+
+func TestJSONContentNegotiation(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "negotiated_requests"
+	cfg.MetricsPort = 0
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "json-negotiation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html;q=0.9, application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected JSON content type, got %q", contentType)
+	}
+
+	var metrics []*Metric
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(metrics))
+	}
+	metric := metrics[0]
+	if metric.Name != "negotiated_requests" || metric.Type != MetricTypeCounter || metric.Value != 1 || metric.Labels["x_user_id"] != "user123" {
+		t.Errorf("unexpected series %+v", metric)
+	}
+	if metric.LastUpdated.IsZero() {
+		t.Error("expected lastUpdated to be set")
+	}
+
+	// Without the Accept header the text format is still served
+	if output := scrape(t, plugin.ActualPort()); !strings.Contains(output, `negotiated_requests_total{x_user_id="user123"} 1`) {
+		t.Errorf("expected Prometheus output, got:\n%s", output)
+	}
+}
+
+func TestDisableServer(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "embedded_requests"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	// The default port stays free, so a second instance can use it as well
+	handler, err := New(ctx, next, cfg, "disabled-server-first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(ctx, next, cfg, "disabled-server-second"); err != nil {
+		t.Fatalf("expected instances without servers not to conflict, got %v", err)
+	}
+
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	if plugin.server != nil {
+		t.Fatal("expected no metrics server to be started")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The metrics handler serves the same endpoints as the server would
+	metricsServer := httptest.NewServer(plugin.MetricsHandler())
+	defer metricsServer.Close()
+
+	status, body := get(t, metricsServer.URL+"/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if !strings.Contains(body, `embedded_requests_total{x_user_id="user123"} 1`+"\n") {
+		t.Errorf("expected the collected series, got:\n%s", body)
+	}
+	if status, _ := get(t, metricsServer.URL+"/metrics.json"); status != http.StatusOK {
+		t.Errorf("expected the JSON endpoint to be served, got status %d", status)
+	}
+}
+
+func TestMetricsHandlerOfRunningServer(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "mounted_requests"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "metrics-handler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The handler can be mounted elsewhere while the server keeps running
+	scrapeReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	plugin.MetricsHandler().ServeHTTP(recorder, scrapeReq)
+
+	if body := recorder.Body.String(); !strings.Contains(body, `mounted_requests_total{x_user_id="user123"} 1`+"\n") {
+		t.Errorf("expected the collected series, got:\n%s", body)
+	}
+}
+
+func TestScrapesAreByteIdentical(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "stable_requests", Type: "counter", Headers: []string{"X-User-ID", "X-Region", "X-Tenant"}},
+		{Name: "stable_queue_depth", Type: "gauge", Headers: []string{"X-Region"}, ValueHeader: "X-Queue-Depth"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "stable-scrape-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Enough series and labels that map iteration order would show up in the output
+	for i := 0; i < 50; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", fmt.Sprintf("user%d", i))
+		req.Header.Set("X-Region", fmt.Sprintf("region%d", i%5))
+		req.Header.Set("X-Tenant", fmt.Sprintf("tenant%d", i%3))
+		req.Header.Set("X-Queue-Depth", "7")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	metricsServer := httptest.NewServer(plugin.MetricsHandler())
+	defer metricsServer.Close()
+
+	_, first := get(t, metricsServer.URL+"/metrics")
+	if !strings.Contains(first, `stable_requests_total{x_region="region0",x_tenant="tenant0",x_user_id="user0"} 1`+"\n") {
+		t.Fatalf("expected labels sorted by name, got:\n%s", first)
+	}
+	if _, second := get(t, metricsServer.URL+"/metrics"); second != first {
+		t.Errorf("expected byte-identical scrapes of an unchanged store, got:\n%s\nthen:\n%s", first, second)
+	}
+}
+
+// writeSelfSignedCertificate writes a certificate for localhost and its key into the directory.
+func writeSelfSignedCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "metrics.crt")
+	keyFile = filepath.Join(dir, "metrics.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMetricsTLS(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCertificate(t, t.TempDir())
+
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "tls_requests"
+	cfg.MetricsPort = 0
+	cfg.MetricsTLS = TLSCertificate{CertFile: certFile, KeyFile: keyFile}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // The certificate is self-signed.
+	}}
+	scrapeReq, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://localhost:%d/metrics", plugin.ActualPort()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(scrapeReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != prometheusContentType {
+		t.Errorf("unexpected response %d with content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `tls_requests_total{x_user_id="user123"} 1`+"\n") {
+		t.Errorf("expected the collected series, got:\n%s", body)
+	}
+}
+
+func TestInvalidMetricsTLS(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCertificate(t, t.TempDir())
+
+	tests := map[string]TLSCertificate{
+		"missing key":       {CertFile: certFile},
+		"missing cert":      {KeyFile: keyFile},
+		"nonexistent files": {CertFile: certFile + ".missing", KeyFile: keyFile},
+		"swapped files":     {CertFile: keyFile, KeyFile: certFile},
+	}
+
+	for name, files := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		cfg.MetricsTLS = files
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-tls-test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected bool
+	}{
+		{accept: "application/openmetrics-text", expected: true},
+		{accept: "application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.3,*/*;q=0.2", expected: true},
+		{accept: "text/plain, Application/OpenMetrics-Text ; version=0.0.1", expected: true},
+		{accept: "application/openmetrics-text;q=0", expected: false},
+		{accept: "text/plain;version=0.0.4", expected: false},
+		{accept: "*/*", expected: false},
+		{accept: "", expected: false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		if accepted := acceptsMediaType(req, openMetricsMediaType); accepted != test.expected {
+			t.Errorf("Accept %q: expected %v, got %v", test.accept, test.expected, accepted)
+		}
+	}
+}
+
+func TestOpenMetricsNegotiation(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.DisableServer = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "negotiated_requests", Type: "counter", Headers: []string{"X-User-ID"}},
+		{Name: "negotiated_queue_depth", Type: "gauge", Headers: []string{"X-User-ID"}, ValueHeader: "X-Queue-Depth"},
+	}
+
+	ctx := context.Background()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+
+	handler, err := New(ctx, next, cfg, "negotiation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	req.Header.Set("X-Queue-Depth", "3")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	scrapeWith := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		plugin.MetricsHandler().ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	openMetrics := scrapeWith("application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.3")
+	if contentType := openMetrics.Header().Get("Content-Type"); contentType != openMetricsContentType {
+		t.Errorf("expected content type %q, got %q", openMetricsContentType, contentType)
+	}
+	expected := "# HELP negotiated_queue_depth Custom metric based on HTTP headers\n" +
+		"# TYPE negotiated_queue_depth gauge\n" +
+		`negotiated_queue_depth{x_user_id="user123"} 3` + "\n" +
+		"# HELP negotiated_requests Custom metric based on HTTP headers\n" +
+		"# TYPE negotiated_requests counter\n" +
+		`negotiated_requests_total{x_user_id="user123"} 1` + "\n" +
+		"# EOF\n"
+	if body := openMetrics.Body.String(); body != expected {
+		t.Errorf("unexpected OpenMetrics output:\n%s\nwant:\n%s", body, expected)
+	}
+
+	text := scrapeWith("text/plain;version=0.0.4")
+	if contentType := text.Header().Get("Content-Type"); contentType != prometheusContentType {
+		t.Errorf("expected content type %q, got %q", prometheusContentType, contentType)
+	}
+	expected = "# HELP negotiated_queue_depth Custom metric based on HTTP headers\n" +
+		"# TYPE negotiated_queue_depth gauge\n" +
+		`negotiated_queue_depth{x_user_id="user123"} 3` + "\n" +
+		"# HELP negotiated_requests_total Custom metric based on HTTP headers\n" +
+		"# TYPE negotiated_requests_total counter\n" +
+		`negotiated_requests_total{x_user_id="user123"} 1` + "\n"
+	if body := text.Body.String(); body != expected {
+		t.Errorf("unexpected Prometheus output:\n%s\nwant:\n%s", body, expected)
+	}
+}
+
+func TestResetEndpoint(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "reset_requests"
+	cfg.DisableServer = true
+	cfg.EnableReset = true
+	cfg.MetricsAuthToken = "secret"
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "reset-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	for _, user := range []string{"user1", "user2"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	reset := func(method, target, token string) (int, string) {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		plugin.MetricsHandler().ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if status, _ := reset(http.MethodPost, "/reset", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected resets without the token to be refused, got status %d", status)
+	}
+	if status, _ := reset(http.MethodGet, "/reset", "secret"); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for GET, got %d", status)
+	}
+	if status, _ := reset(http.MethodPost, "/reset?mode=all", "secret"); status != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown mode, got %d", status)
+	}
+	if count := plugin.store.seriesCount(); count != 2 {
+		t.Fatalf("expected 2 series before the reset, got %d", count)
+	}
+
+	// Zeroing keeps the series
+	status, body := reset(http.MethodPost, "/reset?mode=zero", "secret")
+	if status != http.StatusOK || body != `{"mode":"zero","series":2}` {
+		t.Fatalf("expected 2 zeroed series, got status %d: %s", status, body)
+	}
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, `reset_requests_total{x_user_id="user1"} 0`+"\n") {
+		t.Errorf("expected the series to be zeroed, got:\n%s", output)
+	}
+
+	status, body = reset(http.MethodPost, "/reset", "secret")
+	if status != http.StatusOK || body != `{"mode":"clear","series":2}` {
+		t.Fatalf("expected 2 cleared series, got status %d: %s", status, body)
+	}
+	if count := plugin.store.seriesCount(); count != 0 {
+		t.Errorf("expected the series count to be reset, got %d", count)
+	}
+	if output := plugin.renderPrometheusFormat(); output != "" {
+		t.Errorf("expected an empty scrape after the reset, got:\n%s", output)
+	}
+}
+
+func TestResetZeroKeepsInFlightGauges(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "reset_in_flight"
+	cfg.DisableServer = true
+	cfg.EnableReset = true
+	cfg.TrackInFlight = true
+
+	ctx := context.Background()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Wait") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+	})
+
+	handler, err := New(ctx, next, cfg, "reset-in-flight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	serve := func(wait bool) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("X-User-ID", "user1")
+		if wait {
+			req.Header.Set("X-Wait", "1")
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(true)
+	}()
+	<-entered
+
+	// Zeroing while the request is in flight leaves its gauge counting it
+	rec := httptest.NewRecorder()
+	plugin.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reset?mode=zero", nil))
+	if body := rec.Body.String(); rec.Code != http.StatusOK || body != `{"mode":"zero","series":1}` {
+		t.Fatalf("expected only the counter to be zeroed, got status %d: %s", rec.Code, body)
+	}
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, `reset_in_flight_in_flight{x_user_id="user1"} 1`+"\n") {
+		t.Errorf("expected the in-flight gauge to keep counting the request, got:\n%s", output)
+	}
+
+	close(release)
+	<-done
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`reset_in_flight_in_flight{x_user_id="user1"} 0`,
+		`reset_in_flight_total{x_user_id="user1"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestResetEndpointDisabledByDefault(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "reset-disabled-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.(*CustomMetrics).MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reset", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without enableReset, got %d", rec.Code)
+	}
+}
+
+func TestStopDrainsSlowScrape(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "drained_requests"
+	cfg.MetricsPort = 0
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "drain-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+	url := fmt.Sprintf("http://localhost:%d/metrics", plugin.ActualPort())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Holding the shard locks stalls scrapes in the middle of rendering
+	for i := range plugin.store.shards {
+		plugin.store.shards[i].mu.Lock()
+	}
+
+	type scrapeResult struct {
+		status int
+		body   string
+		err    error
+	}
+	scraped := make(chan scrapeResult, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			scraped <- scrapeResult{err: err}
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		scraped <- scrapeResult{status: resp.StatusCode, body: string(body), err: err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- plugin.Stop() }()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("expected Stop to wait for the scrape, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i := range plugin.store.shards {
+		plugin.store.shards[i].mu.Unlock()
+	}
+
+	result := <-scraped
+	if result.err != nil {
+		t.Fatalf("expected the scrape to complete, got %v", result.err)
+	}
+	if result.status != http.StatusOK || !strings.Contains(result.body, `drained_requests_total{x_user_id="user123"} 1`+"\n") {
+		t.Errorf("expected the whole exposition, got status %d:\n%s", result.status, result.body)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a graceful shutdown, got %v", err)
+	}
+}
+
+// freePort returns a port nothing listens on, for instances sharing a metrics server, which
+// they only do on a port known in advance.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// occupyPort listens on a random port, as another process would, and returns it.
+func occupyPort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestPortInUse(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = occupyPort(t)
+
+	_, err := New(context.Background(), http.NotFoundHandler(), cfg, "port-in-use-test")
+	if !errors.Is(err, ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected the listener error to be wrapped, got %v", err)
+	}
+}
+
+func TestPortFallback(t *testing.T) {
+	previous := currentLogger()
+	defer SetLogger(previous)
+	captured := capturingLogger{messages: make(chan string, 10)}
+	SetLogger(captured)
+
+	port := occupyPort(t)
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "fallback_requests"
+	cfg.MetricsPort = port
+	cfg.PortFallback = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "port-fallback-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	actualPort := plugin.ActualPort()
+	if actualPort == 0 || actualPort == port {
+		t.Fatalf("expected a random port other than %d, got %d", port, actualPort)
+	}
+
+	var logged bool
+	for len(captured.messages) > 0 {
+		if strings.Contains(<-captured.messages, fmt.Sprintf("on port %d instead", actualPort)) {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("expected the fallback to be logged")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	status, body := get(t, fmt.Sprintf("http://localhost:%d/metrics", actualPort))
+	if status != http.StatusOK || !strings.Contains(body, `fallback_requests_total{x_user_id="user123"} 1`+"\n") {
+		t.Errorf("expected the metrics on the fallback port, got status %d:\n%s", status, body)
+	}
+}
+
+func TestActualPort(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "actual-port-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	port := plugin.ActualPort()
+	if port == 0 {
+		t.Fatal("expected the randomly chosen port")
+	}
+	if status, _ := get(t, fmt.Sprintf("http://localhost:%d/metrics", port)); status != http.StatusOK {
+		t.Errorf("expected status 200 on the reported port, got %d", status)
+	}
+
+	cfg.DisableServer = true
+	handler, err = New(context.Background(), http.NotFoundHandler(), cfg, "actual-port-disabled-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := handler.(*CustomMetrics).ActualPort(); port != 0 {
+		t.Errorf("expected port 0 without a server, got %d", port)
+	}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.MetricName = "self_metrics_requests"
+		cfg.DisableServer = true
+		cfg.DisableSelfMetrics = disabled
+
+		ctx := context.Background()
+		handler, err := New(ctx, http.NotFoundHandler(), cfg, "self-metrics-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin := handler.(*CustomMetrics)
+
+		for _, user := range []string{"alice", "bob"} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-User-ID", user)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		var body string
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			plugin.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			body = rec.Body.String()
+		}
+
+		if disabled {
+			if strings.Contains(body, "custommetrics_") {
+				t.Errorf("expected no self metrics when disabled, got:\n%s", body)
+			}
+			continue
+		}
+		for _, line := range []string{
+			"# HELP custommetrics_scrapes_total Number of scrapes of the metrics endpoints.",
+			`custommetrics_scrapes_total{plugin="self-metrics-test"} 2`,
+			`custommetrics_series{plugin="self-metrics-test"} 2`,
+			`custommetrics_dropped_samples_total{plugin="self-metrics-test"} 0`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("expected output to contain %q, got:\n%s", line, body)
+			}
+		}
+	}
+}
+
+func TestDroppedSamples(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.MaxSeries = 2
+	cfg.Metrics = []MetricDefinition{
+		{Name: "dropped_depth", Type: MetricTypeGauge, Headers: []string{"X-User-ID"}, ValueHeader: "X-Value"},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "dropped-samples-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	send := func(user, value string) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", user)
+		req.Header.Set("X-Value", value)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A missing value is not a dropped sample, an unparsable one and one beyond the limit are
+	send("alice", "")
+	send("alice", "full")
+	send("bob", "2")
+	send("carol", "3")
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`custommetrics_dropped_samples_total{plugin="dropped-samples-test"} 2`,
+		`custommetrics_overflow_observations_total{plugin="dropped-samples-test"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricsPort = 0
+	cfg.MetricsAuthToken = "secret"
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "probe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+	t.Cleanup(func() { _ = plugin.Stop() })
+
+	base := fmt.Sprintf("http://localhost:%d", plugin.ActualPort())
+
+	// Probes need no token, unlike the metrics
+	if status, body := get(t, base+"/healthz"); status != http.StatusOK || body != "ok" {
+		t.Errorf("expected /healthz to answer 200 ok, got %d %q", status, body)
+	}
+	if status, _ := get(t, base+"/metrics"); status != http.StatusUnauthorized {
+		t.Errorf("expected /metrics to require the token, got %d", status)
+	}
+	if status, _ := get(t, base+"/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to answer 503 before any request, got %d", status)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if status, body := get(t, base+"/readyz"); status != http.StatusOK || body != "ok" {
+		t.Errorf("expected /readyz to answer 200 ok after a request, got %d %q", status, body)
+	}
+}
+
+func TestReadyWithoutTraffic(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.ReadyWithoutTraffic = true
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "ready-without-traffic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.(*CustomMetrics).MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /readyz to answer 200 before any request, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package custommetrics
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statsdMaxPacketSize keeps batched packets within a typical Ethernet MTU.
+	statsdMaxPacketSize = 1432
+
+	// statsdFlushInterval bounds how long an observation waits in a partially filled packet.
+	statsdFlushInterval = time.Second
+)
+
+// StatsD metric types of the pushed observations.
+const (
+	statsdCounter   = "c"
+	statsdGauge     = "g"
+	statsdTiming    = "ms"
+	statsdHistogram = "h"
+)
+
+// statsdTagReplacer replaces the characters that delimit DogStatsD lines and tags.
+var statsdTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// statsdClient pushes observations to a StatsD server over UDP. Lines are batched into
+// packets of up to statsdMaxPacketSize bytes, sent when full and at least once per
+// statsdFlushInterval, so that a request does not cost a syscall.
+type statsdClient struct {
+	conn net.Conn
+
+	mu     sync.Mutex
+	buffer []byte
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newStatsDClient connects to the StatsD server and starts flushing in the background.
+func newStatsDClient(address string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsDAddress %s: %w", address, err)
+	}
+
+	client := &statsdClient{
+		conn:    conn,
+		buffer:  make([]byte, 0, statsdMaxPacketSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go client.run()
+	return client, nil
+}
+
+// run flushes the buffered lines periodically until the client is closed.
+func (s *statsdClient) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// push buffers an observation as a DogStatsD line, e.g. "requests:1|c|#tenant:acme".
+func (s *statsdClient) push(name string, value float64, metricType string, labels map[string]string) {
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + metricType
+	if len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for labelName := range labels {
+			names = append(names, labelName)
+		}
+		sort.Strings(names)
+
+		tags := make([]string, 0, len(names))
+		for _, labelName := range names {
+			tags = append(tags, labelName+":"+statsdTagReplacer.Replace(labels[labelName]))
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buffer) > 0 && len(s.buffer)+1+len(line) > statsdMaxPacketSize {
+		s.flush()
+	}
+	if len(s.buffer) > 0 {
+		s.buffer = append(s.buffer, '\n')
+	}
+	s.buffer = append(s.buffer, line...)
+}
+
+// flush sends the buffered lines as one packet. The caller must hold s.mu.
+func (s *statsdClient) flush() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	// Dropped packets are not retried, StatsD delivery is best effort
+	_, _ = s.conn.Write(s.buffer)
+	s.buffer = s.buffer[:0]
+}
+
+// close stops the background flushing, sends the remaining lines and closes the connection.
+func (s *statsdClient) close() error {
+	close(s.stop)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush()
+	return s.conn.Close()
+}
+
+// pushStatsD pushes an observation to the StatsD server, if one is configured.
+func (c *CustomMetrics) pushStatsD(name string, value float64, metricType string, labels map[string]string) {
+	// StatsD has no syntax for NaN or infinite values, which only gauges hold
+	if c.statsd == nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	c.statsd.push(name, value, metricType, c.withConstLabels(labels))
+}
@@ -0,0 +1,172 @@
+package custommetrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStatsDLines reads packets from the listener until the expected number of lines arrived.
+func readStatsDLines(t *testing.T, listener net.PacketConn, expected int) (lines []string, packets int) {
+	t.Helper()
+
+	buffer := make([]byte, 65536)
+	for len(lines) < expected {
+		if err := listener.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("expected %d lines, got %d: %v", expected, len(lines), err)
+		}
+		if n > statsdMaxPacketSize {
+			t.Errorf("expected packets of at most %d bytes, got %d", statsdMaxPacketSize, n)
+		}
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+		packets++
+	}
+	return lines, packets
+}
+
+func TestStatsDPush(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.StatsDAddress = listener.LocalAddr().String()
+	cfg.ConstLabels = map[string]string{"cluster": "eu-west"}
+	cfg.Metrics = []MetricDefinition{
+		{Name: "statsd_requests", Type: "counter", Headers: []string{"X-Tenant"}},
+		{Name: "statsd_queue_depth", Type: "gauge", Headers: []string{"X-Tenant"}, ValueHeader: "X-Queue-Depth"},
+		{Name: "statsd_latency", Type: "histogram", Headers: []string{"X-Tenant"}, ValueHeader: "X-Latency"},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "statsd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tenant := range []string{"acme", "globex|corp"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("X-Queue-Depth", "7")
+		req.Header.Set("X-Latency", "12.5")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Stopping flushes the lines buffered so far, batched into a single packet
+	if err := handler.(*CustomMetrics).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, packets := readStatsDLines(t, listener, 6)
+	if packets != 1 {
+		t.Errorf("expected the observations to be batched into 1 packet, got %d", packets)
+	}
+	expected := []string{
+		"statsd_requests:1|c|#cluster:eu-west,x_tenant:acme",
+		"statsd_queue_depth:7|g|#cluster:eu-west,x_tenant:acme",
+		"statsd_latency:12.5|ms|#cluster:eu-west,x_tenant:acme",
+		"statsd_requests:1|c|#cluster:eu-west,x_tenant:globex_corp",
+		"statsd_queue_depth:7|g|#cluster:eu-west,x_tenant:globex_corp",
+		"statsd_latency:12.5|ms|#cluster:eu-west,x_tenant:globex_corp",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestStatsDMeasurementTypes(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.StatsDAddress = listener.LocalAddr().String()
+	cfg.MetricHeaders = []string{"X-Tenant"}
+	cfg.MetricName = "statsd_measured"
+	cfg.MeasureDuration = true
+	cfg.RequestSizeMetric = true
+	cfg.ResponseSizeMetric = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "statsd-measured-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := handler.(*CustomMetrics).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Durations are timings in milliseconds, sizes are plain histograms
+	lines, _ := readStatsDLines(t, listener, 4)
+	types := make(map[string]string)
+	for _, line := range lines {
+		name := line[:strings.Index(line, ":")]
+		types[name] = strings.SplitN(line, "|", 3)[1]
+	}
+	for name, expected := range map[string]string{
+		"statsd_measured":                "c",
+		"statsd_measured_duration":       "ms",
+		"statsd_measured_request_bytes":  "h",
+		"statsd_measured_response_bytes": "h",
+	} {
+		if types[name] != expected {
+			t.Errorf("expected %s to be pushed as |%s, got lines:\n%s", name, expected, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestStatsDBatchesIntoFullPackets(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	client, err := newStatsDClient(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough lines to fill several packets
+	for i := 0; i < 200; i++ {
+		client.push("batched_requests", 1, statsdCounter, map[string]string{"tenant": "acme"})
+	}
+	if err := client.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, packets := readStatsDLines(t, listener, 200)
+	if packets < 2 {
+		t.Errorf("expected the lines to span several packets, got %d", packets)
+	}
+	for _, line := range lines {
+		if line != "batched_requests:1|c|#tenant:acme" {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
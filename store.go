@@ -0,0 +1,241 @@
+package custommetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storeShards is the number of independently locked shards a store is split into.
+const storeShards = 16
+
+// MetricsStore holds all collected metrics.
+// Series are spread over shards by key so that requests touching different series
+// rarely contend on the same lock; each series guards its own values.
+type MetricsStore struct {
+	shards [storeShards]storeShard
+	series int64 // Number of series in the shards, excluding overflow series. Accessed atomically.
+
+	// Metrics about the plugin itself, keyed by name, and their labels. Without labels the store
+	// does not report them.
+	internalMu     sync.Mutex
+	internal       map[string]*series
+	internalLabels map[string]string
+}
+
+// internalHelp is the HELP text of the metrics the plugin reports about itself.
+var internalHelp = map[string]string{
+	scrapesMetricName:               "Number of scrapes of the metrics endpoints.",
+	seriesMetricName:                "Number of series currently held, overflow series included.",
+	droppedSamplesMetricName:        "Number of observations whose value was not a finite number or whose labels were folded beyond the series limit.",
+	overflowObservationsMetricName:  "Number of observations folded into overflow series beyond the series limit.",
+	unlabeledObservationsMetricName: "Number of observations skipped because none of their labels had a value.",
+	droppedObservationsMetricName:   "Number of observations dropped because the asynchronous collection queue was full.",
+}
+
+// storeShard is one lock-protected partition of a store.
+type storeShard struct {
+	mu      sync.RWMutex
+	metrics map[string]*series
+}
+
+// newMetricsStore creates an empty store.
+func newMetricsStore() *MetricsStore {
+	store := &MetricsStore{internal: make(map[string]*series)}
+	for i := range store.shards {
+		store.shards[i].metrics = make(map[string]*series)
+	}
+	return store
+}
+
+// shard returns the shard a key belongs to, hashing the key with FNV-1a without allocating.
+func (s *MetricsStore) shard(key string) *storeShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return &s.shards[hash%storeShards]
+}
+
+// put stores a series under a key without counting it against the series limit.
+func (s *MetricsStore) put(key string, metric *series) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.metrics[key] = metric
+}
+
+// get returns the series stored under a key, or nil.
+func (s *MetricsStore) get(key string) *series {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.metrics[key]
+}
+
+// len returns the number of series in the store, including overflow series.
+func (s *MetricsStore) len() int {
+	var count int
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		count += len(shard.metrics)
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
+// seriesCount returns the number of series counted against the series limit.
+func (s *MetricsStore) seriesCount() int {
+	return int(atomic.LoadInt64(&s.series))
+}
+
+// clear deletes every series, including internal metrics, so collection starts over from zero.
+// It returns the number of series deleted. Every shard is locked at once, so no observation
+// lands in a cleared shard while others still hold their series.
+func (s *MetricsStore) clear() int {
+	s.lockAll()
+	defer s.unlockAll()
+
+	var cleared int
+	for i := range s.shards {
+		shard := &s.shards[i]
+		cleared += len(shard.metrics)
+		shard.metrics = make(map[string]*series)
+	}
+	atomic.StoreInt64(&s.series, 0)
+
+	cleared += len(s.internal)
+	s.internal = make(map[string]*series)
+	s.registerInternalLocked()
+	return cleared
+}
+
+// zero resets the values of every series, including internal metrics, while keeping the series.
+// In-flight gauges keep counting the requests being served. It returns the number of series
+// zeroed. Every shard is locked at once, like when clearing.
+func (s *MetricsStore) zero(now time.Time) int {
+	s.lockAll()
+	defer s.unlockAll()
+
+	var zeroed int
+	for i := range s.shards {
+		for _, metric := range s.shards[i].metrics {
+			if metric.zero(now) {
+				zeroed++
+			}
+		}
+	}
+	for _, metric := range s.internal {
+		if metric.zero(now) {
+			zeroed++
+		}
+	}
+	return zeroed
+}
+
+// lockAll locks every shard in order, then the internal metrics.
+func (s *MetricsStore) lockAll() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+	s.internalMu.Lock()
+}
+
+// unlockAll releases the locks taken by lockAll.
+func (s *MetricsStore) unlockAll() {
+	s.internalMu.Unlock()
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// enableInternalMetrics makes the store report metrics about the plugin with the given labels,
+// registering those reported even before anything happens.
+func (s *MetricsStore) enableInternalMetrics(labels map[string]string) {
+	s.internalMu.Lock()
+	defer s.internalMu.Unlock()
+
+	s.internalLabels = labels
+	s.registerInternalLocked()
+}
+
+// registerInternalLocked registers the internal metrics reported even before anything happens.
+// Callers hold internalMu.
+func (s *MetricsStore) registerInternalLocked() {
+	if s.internalLabels == nil {
+		return
+	}
+	s.internalSeriesLocked(scrapesMetricName, MetricTypeCounter)
+	s.internalSeriesLocked(seriesMetricName, MetricTypeGauge)
+	s.internalSeriesLocked(droppedSamplesMetricName, MetricTypeCounter)
+}
+
+// internalSeriesLocked returns an internal metric, creating it when missing. Callers hold internalMu.
+func (s *MetricsStore) internalSeriesLocked(name, metricType string) *series {
+	metric := s.internal[name]
+	if metric == nil {
+		metric = &series{Metric: Metric{Name: name, Type: metricType, Labels: s.internalLabels, help: internalHelp[name], startedAt: time.Now()}}
+		s.internal[name] = metric
+	}
+	return metric
+}
+
+// incrementInternal increments one of the counters the plugin reports about itself, unless
+// internal metrics are disabled.
+func (s *MetricsStore) incrementInternal(name string, now time.Time) {
+	s.internalMu.Lock()
+	defer s.internalMu.Unlock()
+
+	if s.internalLabels == nil {
+		return
+	}
+	metric := s.internalSeriesLocked(name, MetricTypeCounter)
+	metric.addCounter(1)
+	metric.touch(now)
+}
+
+// internalMetric returns one of the metrics the plugin reports about itself, or nil.
+func (s *MetricsStore) internalMetric(name string) *series {
+	s.internalMu.Lock()
+	defer s.internalMu.Unlock()
+
+	return s.internal[name]
+}
+
+// snapshot returns point-in-time copies of all series in the store, including internal metrics.
+// Shards are read one at a time, so collection in other shards is never blocked. Gauge
+// aggregation windows are closed when closeWindows is set, as for scrapes.
+func (s *MetricsStore) snapshot(closeWindows bool) []*Metric {
+	var snapshots []*Metric
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		for _, metric := range shard.metrics {
+			snapshots = append(snapshots, metric.snapshot(closeWindows))
+		}
+		shard.mu.RUnlock()
+	}
+
+	s.internalMu.Lock()
+	if s.internalLabels != nil {
+		gauge := s.internalSeriesLocked(seriesMetricName, MetricTypeGauge)
+		gauge.mu.Lock()
+		gauge.Value = float64(len(snapshots))
+		gauge.mu.Unlock()
+	}
+	for _, metric := range s.internal {
+		snapshots = append(snapshots, metric.snapshot(closeWindows))
+	}
+	s.internalMu.Unlock()
+
+	return snapshots
+}
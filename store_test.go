@@ -0,0 +1,245 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreShardsSpreadSeries(t *testing.T) {
+	store := newMetricsStore()
+	for i := 0; i < 1000; i++ {
+		store.put("series_"+strconv.Itoa(i), &series{Metric: Metric{Name: "series", Type: MetricTypeCounter}})
+	}
+
+	if count := store.len(); count != 1000 {
+		t.Fatalf("expected 1000 series, got %d", count)
+	}
+	for i := range store.shards {
+		if len(store.shards[i].metrics) == 0 {
+			t.Errorf("expected every shard to hold series, shard %d is empty", i)
+		}
+	}
+	if snapshots := store.snapshot(false); len(snapshots) != 1000 {
+		t.Errorf("expected 1000 snapshots, got %d", len(snapshots))
+	}
+}
+
+func TestGetSeriesConcurrentCreation(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableSelfMetrics = true
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MaxSeries = 0
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "concurrent-creation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Every goroutine races to create the same series, which must end up created once each
+	definition := plugin.definitions[0]
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				labels := map[string]string{"x_user_id": strconv.Itoa(i)}
+				metric := plugin.getSeries(plugin.createMetricKey(definition.Name, labels), definition, nil, labels)
+				metric.addCounter(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := plugin.store.seriesCount(); count != 100 {
+		t.Errorf("expected 100 series, got %d", count)
+	}
+	for _, metric := range plugin.store.snapshot(false) {
+		if metric.Value != 8 {
+			t.Errorf("expected every series to be incremented 8 times, got %v for %v", metric.Value, metric.Labels)
+		}
+	}
+}
+
+func BenchmarkGetSeriesParallel(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+	cfg.MaxSeries = 0
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "get-series-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		b.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	definition := plugin.definitions[0]
+	keys := make([]string, 4096)
+	labels := make([]map[string]string, len(keys))
+	for i := range keys {
+		labels[i] = map[string]string{"x_user_id": strconv.Itoa(i)}
+		keys[i] = plugin.createMetricKey(definition.Name, labels[i])
+	}
+
+	// Mix lookups of existing series with the creation of new ones
+	b.SetParallelism(8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			metric := plugin.getSeries(keys[i%len(keys)], definition, nil, labels[i%len(keys)])
+			metric.addCounter(1)
+			i += 7
+		}
+	})
+}
+
+func TestCounterConcurrentIncrements(t *testing.T) {
+	metric := &series{Metric: Metric{Name: "counter", Type: MetricTypeCounter}}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				metric.addCounter(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value := metric.snapshot(false).Value; value != 4000 {
+		t.Errorf("expected counter value 4000, got %v", value)
+	}
+}
+
+// BenchmarkCounterIncrement increments a few existing counter series from many goroutines.
+func BenchmarkCounterIncrement(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.DisableServer = true
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "counter-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		b.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	definition := plugin.definitions[0]
+	keys := make([]string, 4)
+	labels := make([]map[string]string, len(keys))
+	for i := range keys {
+		labels[i] = map[string]string{"x_user_id": strconv.Itoa(i)}
+		keys[i] = plugin.createMetricKey(definition.Name, labels[i])
+	}
+	now := time.Now()
+
+	b.SetParallelism(8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			metric := plugin.getSeries(keys[i%len(keys)], definition, nil, labels[i%len(keys)])
+			metric.addCounter(1)
+			metric.touch(now)
+			i++
+		}
+	})
+}
+
+func TestMetricKeysDoNotCollide(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"A", "A-B", "X-User-ID"}
+	cfg.MetricName = "collision_test"
+	cfg.DisableServer = true
+	cfg.OmitEmptyLabels = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "collision-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// {a: "b_c"} and {a_b: "c"} used to share the key collision_test_a_b_c
+	for _, headers := range []map[string]string{
+		{"A": "b_c"},
+		{"A-B": "c"},
+		{"X-User-ID": "user_1_a"},
+		{"X-User-ID": "user", "A": "1_a"},
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if count := plugin.store.seriesCount(); count != 4 {
+		t.Errorf("expected 4 distinct series, got %d:\n%s", count, plugin.renderPrometheusFormat())
+	}
+}
+
+func TestIdenticalLabelsShareSeries(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID", "X-Tenant", "X-Region", "X-Plan"}
+	cfg.MetricName = "same_series_test"
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "same-series-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin, ok := handler.(*CustomMetrics)
+	if !ok {
+		t.Fatal("handler is not a CustomMetrics instance")
+	}
+
+	// Map iteration order differs between requests, the key must not
+	for i := 0; i < 100; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Region", "eu")
+		req.Header.Set("X-Plan", "pro")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if count := plugin.store.seriesCount(); count != 1 {
+		t.Errorf("expected 1 series, got %d", count)
+	}
+	expected := `same_series_test_total{x_plan="pro",x_region="eu",x_tenant="acme",x_user_id="user123"} 100`
+	if output := plugin.renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+}
@@ -0,0 +1,161 @@
+package custommetrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// DefaultSummaryQuantiles are the default quantiles reported by summary metrics.
+var DefaultSummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// defaultSummaryMaxSamples is the number of observations kept per summary series.
+const defaultSummaryMaxSamples = 1024
+
+// quantileEstimator estimates quantiles over a stream of observations using a
+// bounded reservoir sample. It is not safe for concurrent use; callers guard it
+// with the store lock.
+//
+// A reservoir of n samples is a uniform sample of every observation, so the rank of
+// an estimated quantile q is off by about sqrt(q(1-q)/n): ±1.6% for the median and
+// ±0.3% for p99 with the default 1024 samples. Windowed estimators instead keep the
+// most recent observations, and are exact while the window holds at most n of them.
+type quantileEstimator struct {
+	samples    []float64
+	maxSamples int
+	seen       uint64
+	rng        *rand.Rand
+
+	// Windowed estimators record when each sample was observed, and overwrite the
+	// oldest sample at next once full
+	maxAge time.Duration
+	times  []time.Time
+	next   int
+	now    func() time.Time
+}
+
+// newQuantileEstimator creates an estimator keeping at most maxSamples observations.
+func newQuantileEstimator(maxSamples int) *quantileEstimator {
+	return &quantileEstimator{
+		samples:    make([]float64, 0, maxSamples),
+		maxSamples: maxSamples,
+		rng:        rand.New(rand.NewSource(rand.Int63())), //nolint:gosec // Sampling does not need a secure source.
+	}
+}
+
+// newWindowedQuantileEstimator creates an estimator over the most recent maxSamples
+// observations made within maxAge.
+func newWindowedQuantileEstimator(maxSamples int, maxAge time.Duration, now func() time.Time) *quantileEstimator {
+	return &quantileEstimator{
+		samples:    make([]float64, 0, maxSamples),
+		maxSamples: maxSamples,
+		maxAge:     maxAge,
+		times:      make([]time.Time, 0, maxSamples),
+		now:        now,
+	}
+}
+
+// insert adds an observation, replacing a random sample once the reservoir is full,
+// or the oldest sample for windowed estimators.
+func (e *quantileEstimator) insert(value float64) {
+	e.seen++
+	if e.maxAge > 0 {
+		now := e.now()
+		e.expire(now)
+		if len(e.samples) < e.maxSamples {
+			e.samples = append(e.samples, value)
+			e.times = append(e.times, now)
+			return
+		}
+		e.samples[e.next] = value
+		e.times[e.next] = now
+		e.next = (e.next + 1) % e.maxSamples
+		return
+	}
+
+	if len(e.samples) < e.maxSamples {
+		e.samples = append(e.samples, value)
+		return
+	}
+
+	if i := e.rng.Int63n(int64(e.seen)); i < int64(e.maxSamples) {
+		e.samples[i] = value
+	}
+}
+
+// expire drops the samples of a windowed estimator observed more than maxAge before now,
+// keeping the others oldest first.
+func (e *quantileEstimator) expire(now time.Time) {
+	cutoff := now.Add(-e.maxAge)
+	if len(e.times) == 0 || e.times[e.next].After(cutoff) {
+		// The oldest sample is still within the window
+		return
+	}
+
+	samples := make([]float64, 0, e.maxSamples)
+	times := make([]time.Time, 0, e.maxSamples)
+	for i := range e.times {
+		j := (e.next + i) % len(e.times)
+		if e.times[j].After(cutoff) {
+			samples = append(samples, e.samples[j])
+			times = append(times, e.times[j])
+		}
+	}
+	e.samples, e.times, e.next = samples, times, 0
+}
+
+// reset drops every observation.
+func (e *quantileEstimator) reset() {
+	e.samples = e.samples[:0]
+	e.times = e.times[:0]
+	e.seen = 0
+	e.next = 0
+}
+
+// clone returns a copy of the estimator holding the same samples, without those that
+// fell out of the window. The copy is only meant to be queried.
+func (e *quantileEstimator) clone() *quantileEstimator {
+	if e.maxAge > 0 {
+		e.expire(e.now())
+	}
+	return &quantileEstimator{
+		samples:    append([]float64(nil), e.samples...),
+		maxSamples: e.maxSamples,
+		seen:       e.seen,
+	}
+}
+
+// merge returns a new estimator pooling the samples of both estimators.
+// The result is only meant to be queried.
+func (e *quantileEstimator) merge(other *quantileEstimator) *quantileEstimator {
+	return &quantileEstimator{
+		samples:    append(append(make([]float64, 0, len(e.samples)+len(other.samples)), e.samples...), other.samples...),
+		maxSamples: e.maxSamples + other.maxSamples,
+		seen:       e.seen + other.seen,
+	}
+}
+
+// query returns the estimated value for each quantile, or NaN when nothing was observed.
+func (e *quantileEstimator) query(quantiles []float64) []float64 {
+	results := make([]float64, len(quantiles))
+	if len(e.samples) == 0 {
+		for i := range results {
+			results[i] = math.NaN()
+		}
+		return results
+	}
+
+	sorted := append([]float64(nil), e.samples...)
+	sort.Float64s(sorted)
+
+	for i, q := range quantiles {
+		// Nearest-rank method
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		results[i] = sorted[rank]
+	}
+	return results
+}
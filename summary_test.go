@@ -0,0 +1,96 @@
+package custommetrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestQuantileEstimator(t *testing.T) {
+	estimator := newQuantileEstimator(defaultSummaryMaxSamples)
+
+	for _, value := range estimator.query([]float64{0.5}) {
+		if !math.IsNaN(value) {
+			t.Errorf("expected NaN for an empty estimator, got %v", value)
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		estimator.insert(float64(i))
+	}
+
+	results := estimator.query([]float64{0, 0.5, 0.9, 0.99, 1})
+	expected := []float64{1, 50, 90, 99, 100}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("quantile %d: expected %v, got %v", i, expected[i], results[i])
+		}
+	}
+}
+
+func TestQuantileEstimatorBounded(t *testing.T) {
+	estimator := newQuantileEstimator(10)
+
+	for i := 0; i < 1000; i++ {
+		estimator.insert(float64(i))
+	}
+
+	if len(estimator.samples) != 10 {
+		t.Errorf("expected reservoir to hold 10 samples, got %d", len(estimator.samples))
+	}
+}
+
+func TestQuantileEstimatorError(t *testing.T) {
+	estimator := newQuantileEstimator(defaultSummaryMaxSamples)
+
+	// Observe a shuffled uniform distribution over [0, 1)
+	const observations = 100000
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(observations) {
+		estimator.insert(float64(i) / observations)
+	}
+
+	quantiles := []float64{0.5, 0.9, 0.99}
+	for i, value := range estimator.query(quantiles) {
+		q := quantiles[i]
+		// Allow five times the standard error of the rank
+		tolerance := 5 * math.Sqrt(q*(1-q)/defaultSummaryMaxSamples)
+		if math.Abs(value-q) > tolerance {
+			t.Errorf("quantile %v: estimate %v is off by more than %v", q, value, tolerance)
+		}
+	}
+}
+
+func TestWindowedQuantileEstimator(t *testing.T) {
+	now := time.Unix(0, 0)
+	estimator := newWindowedQuantileEstimator(4, time.Minute, func() time.Time { return now })
+
+	for i := 1; i <= 6; i++ {
+		estimator.insert(float64(i))
+		now = now.Add(10 * time.Second)
+	}
+
+	// Only the 4 most recent observations are kept
+	if results := estimator.clone().query([]float64{0, 1}); results[0] != 3 || results[1] != 6 {
+		t.Errorf("expected the window to hold 3 to 6, got %v", results)
+	}
+
+	// 3 and 4 were observed over a minute ago
+	now = now.Add(35 * time.Second)
+	if results := estimator.clone().query([]float64{0, 1}); results[0] != 5 || results[1] != 6 {
+		t.Errorf("expected the window to hold 5 to 6, got %v", results)
+	}
+
+	estimator.insert(7)
+	if results := estimator.clone().query([]float64{0, 0.5, 1}); results[0] != 5 || results[1] != 6 || results[2] != 7 {
+		t.Errorf("expected the window to hold 5 to 7, got %v", results)
+	}
+
+	now = now.Add(time.Hour)
+	for _, value := range estimator.clone().query([]float64{0.5}) {
+		if !math.IsNaN(value) {
+			t.Errorf("expected NaN once every observation expired, got %v", value)
+		}
+	}
+}
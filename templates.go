@@ -0,0 +1,235 @@
+package custommetrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// maxTemplatedNames bounds the number of distinct names a metric name template renders to.
+// Further names are folded into the template's fallback name.
+const maxTemplatedNames = 100
+
+// templateData is what metric name and label templates can reference, e.g. {{.Method}}
+// or {{.Header.Get "X-Tenant"}}.
+type templateData struct {
+	Method string
+	Host   string
+	Path   string
+	Header http.Header
+}
+
+// newTemplateData returns the template data of a request.
+func newTemplateData(req *http.Request) templateData {
+	return templateData{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.Path,
+		Header: req.Header,
+	}
+}
+
+// isTemplate reports whether a configured name or value uses template syntax.
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// templateActions matches the actions of a template.
+var templateActions = regexp.MustCompile(`{{.*?}}`)
+
+// invalidMetricNameChars matches runs of characters that are not allowed in metric names.
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+
+// nameTemplate renders a metric name per request, bounding the number of distinct names.
+type nameTemplate struct {
+	text     string
+	template *template.Template
+	fallback string // Name used once the limit is reached or rendering fails, e.g. "requests_other" for "requests_{{.Method}}"
+
+	// Families claimed by the other metrics of the plugin, which rendered names must stay out of.
+	// Without them, rendered names are only kept out of the reserved prefix.
+	families   *metricFamilies
+	metricType string
+
+	mu    sync.RWMutex
+	names map[string]bool
+}
+
+// parseNameTemplate parses a metric name template.
+func parseNameTemplate(text string) (*nameTemplate, error) {
+	parsed, err := template.New("name").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric name template %q: %w", text, err)
+	}
+
+	return &nameTemplate{
+		text:     text,
+		template: parsed,
+		fallback: sanitizeMetricName(templateActions.ReplaceAllString(text, DefaultPathOtherValue)),
+		names:    make(map[string]bool),
+	}, nil
+}
+
+// render returns the sanitized metric name for the request data. Names in the reserved prefix or
+// in the family of another metric are replaced by the fallback name.
+func (t *nameTemplate) render(data templateData) string {
+	var rendered strings.Builder
+	if err := t.template.Execute(&rendered, data); err != nil {
+		return t.fallback
+	}
+	name := sanitizeMetricName(rendered.String())
+	if name == "" {
+		return t.fallback
+	}
+
+	t.mu.RLock()
+	known := t.names[name]
+	t.mu.RUnlock()
+	if known {
+		return name
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.names[name] {
+		return name
+	}
+	if len(t.names) >= maxTemplatedNames || strings.HasPrefix(name, reservedMetricPrefix) ||
+		(t.families != nil && !t.families.claim(t.text, name, t.metricType)) {
+		return t.fallback
+	}
+	t.names[name] = true
+	return name
+}
+
+// metricFamilies records the metric owning each family name a plugin exposes, so a name rendered
+// from a template cannot join the family of another metric, which would expose duplicate or
+// conflicting TYPE lines.
+type metricFamilies struct {
+	measureDuration    bool
+	measureSize        bool
+	requestSizeMetric  bool
+	responseSizeMetric bool
+	trackInFlight      bool
+
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+// newMetricFamilies creates an empty record of the families exposed with the options of a config.
+func newMetricFamilies(config *Config) *metricFamilies {
+	return &metricFamilies{
+		measureDuration:    config.MeasureDuration,
+		measureSize:        config.MeasureSize,
+		requestSizeMetric:  config.RequestSizeMetric,
+		responseSizeMetric: config.ResponseSizeMetric,
+		trackInFlight:      config.TrackInFlight,
+		owners:             make(map[string]string),
+	}
+}
+
+// names returns the family names exposed for a metric: its own and those the options derive from it.
+func (f *metricFamilies) names(name, metricType string) []string {
+	names := appendFamilyNames(nil, name, metricType)
+	if f.measureDuration {
+		names = append(names, name+"_duration_seconds")
+	}
+	if f.measureSize {
+		names = appendFamilyNames(names, name+"_request_bytes_total", MetricTypeCounter)
+		names = appendFamilyNames(names, name+"_response_bytes_total", MetricTypeCounter)
+	}
+	if f.requestSizeMetric {
+		names = append(names, name+"_request_bytes")
+	}
+	if f.responseSizeMetric {
+		names = append(names, name+"_response_bytes")
+	}
+	if f.trackInFlight {
+		names = append(names, name+"_in_flight")
+	}
+	return names
+}
+
+// appendFamilyNames appends the family names of a metric. Counters take their name both with and
+// without the _total suffix, as the exposition formats differ on it.
+func appendFamilyNames(names []string, name, metricType string) []string {
+	if metricType != MetricTypeCounter {
+		return append(names, name)
+	}
+	base := strings.TrimSuffix(name, "_total")
+	return append(names, base, base+"_total")
+}
+
+// claim records the families of a metric name as owned by owner, the configured metric name.
+// It reports false and records nothing when another metric owns one of them.
+func (f *metricFamilies) claim(owner, name, metricType string) bool {
+	names := f.names(name, metricType)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, family := range names {
+		if other, ok := f.owners[family]; ok && other != owner {
+			return false
+		}
+	}
+	for _, family := range names {
+		f.owners[family] = owner
+	}
+	return true
+}
+
+// sanitizeMetricName converts text to a valid Prometheus metric name.
+func sanitizeMetricName(text string) string {
+	sanitized := invalidMetricNameChars.ReplaceAllString(text, "_")
+	sanitized = repeatedUnderscores.ReplaceAllString(sanitized, "_")
+	if len(sanitized) > 0 && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return strings.ToLower(sanitized)
+}
+
+// labelTemplate renders the value of a label per request.
+type labelTemplate struct {
+	name     string
+	template *template.Template
+}
+
+// parseLabelTemplates parses the label value templates, keyed by label name.
+func parseLabelTemplates(templates map[string]string) ([]labelTemplate, error) {
+	parsed := make([]labelTemplate, 0, len(templates))
+	for labelName, text := range templates {
+		if !validLabelName.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+			return nil, fmt.Errorf("invalid label template name %q", labelName)
+		}
+		labelTemplate := labelTemplate{name: labelName}
+		var err error
+		labelTemplate.template, err = template.New(labelName).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for label %q: %w", labelName, err)
+		}
+		parsed = append(parsed, labelTemplate)
+	}
+	return parsed, nil
+}
+
+// render returns the label value for the request data, or an empty value if rendering fails.
+func (t labelTemplate) render(data templateData) string {
+	var rendered strings.Builder
+	if err := t.template.Execute(&rendered, data); err != nil {
+		return ""
+	}
+	return rendered.String()
+}
+
+// metricName returns the name of a metric for a request, rendering it if it is a template.
+func (c *CustomMetrics) metricName(definition MetricDefinition, req *http.Request) string {
+	if nameTemplate := c.nameTemplates[definition.Name]; nameTemplate != nil {
+		return nameTemplate.render(newTemplateData(req))
+	}
+	return definition.Name
+}
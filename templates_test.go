@@ -0,0 +1,171 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetricNameTemplate(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = `requests_{{.Method}}_{{.Header.Get "X-Tenant"}}`
+	cfg.DisableServer = true
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "name-template-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []struct{ method, tenant string }{
+		{http.MethodGet, "acme"},
+		{http.MethodGet, "acme"},
+		{http.MethodPost, "Globex Corp"},
+	} {
+		req, err := http.NewRequestWithContext(ctx, request.method, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Tenant", request.tenant)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Rendered names are sanitized into valid metric names
+	output := handler.(*CustomMetrics).renderPrometheusFormat()
+	for _, line := range []string{
+		`requests_get_acme_total{x_user_id="user123"} 2`,
+		`requests_post_globex_corp_total{x_user_id="user123"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestMetricNameTemplateCardinality(t *testing.T) {
+	nameTemplate, err := parseNameTemplate(`requests_{{.Header.Get "X-Tenant"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxTemplatedNames; i++ {
+		header := http.Header{"X-Tenant": []string{"tenant" + strconv.Itoa(i)}}
+		if name := nameTemplate.render(templateData{Header: header}); name != "requests_tenant"+strconv.Itoa(i) {
+			t.Fatalf("expected name %d to be rendered, got %q", i, name)
+		}
+	}
+
+	// Known names keep rendering while new ones fold into the fallback
+	if name := nameTemplate.render(templateData{Header: http.Header{"X-Tenant": []string{"tenant0"}}}); name != "requests_tenant0" {
+		t.Errorf("expected a known name to be kept, got %q", name)
+	}
+	if name := nameTemplate.render(templateData{Header: http.Header{"X-Tenant": []string{"new"}}}); name != "requests_other" {
+		t.Errorf("expected a new name beyond the limit to fold into requests_other, got %q", name)
+	}
+}
+
+func TestMetricNameTemplateCollisions(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.DisableServer = true
+	cfg.DisableSelfMetrics = true
+	cfg.TrackInFlight = true
+	cfg.Metrics = []MetricDefinition{
+		{Name: "api", Type: MetricTypeGauge, Headers: []string{"X-User-ID"}},
+		{Name: `{{.Header.Get "X-Name"}}`, Type: MetricTypeCounter, Headers: []string{"X-User-ID"}},
+	}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "name-collision-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := handler.(*CustomMetrics)
+
+	// Names in the reserved prefix or in the family of the gauge, whether its own, the in-flight
+	// gauge derived from it or its counter spelling, fold into the fallback name
+	for _, name := range []string{"custommetrics_series", "api", "api_total", "api_in_flight", "orders"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Name", name)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if rendered := plugin.metricName(cfg.Metrics[1], req); name == "orders" && rendered != "orders" {
+			t.Errorf("expected %q to be rendered as is, got %q", name, rendered)
+		} else if name != "orders" && rendered != "other" {
+			t.Errorf("expected %q to fold into the fallback name, got %q", name, rendered)
+		}
+	}
+
+	output := plugin.renderPrometheusFormat()
+	for _, line := range []string{
+		`other_total{x_user_id="user123"} 4`,
+		`orders_total{x_user_id="user123"} 1`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+	if count := strings.Count(output, "# TYPE api "); count != 1 {
+		t.Errorf("expected a single api family, got %d in:\n%s", count, output)
+	}
+}
+
+func TestLabelTemplates(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID"}
+	cfg.MetricName = "label_template_test"
+	cfg.DisableServer = true
+	cfg.LabelTemplates = map[string]string{"route": `{{.Method}} {{.Host}}{{.Path}}`}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "label-template-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.example.com/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-ID", "user123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := `label_template_test_total{route="GET api.example.com/users",x_user_id="user123"} 1`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, line+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", line, output)
+	}
+}
+
+func TestInvalidTemplates(t *testing.T) {
+	tests := map[string]func(*Config){
+		"name syntax":      func(cfg *Config) { cfg.MetricName = "requests_{{.Method" },
+		"label syntax":     func(cfg *Config) { cfg.LabelTemplates = map[string]string{"route": "{{.Method"} },
+		"label name":       func(cfg *Config) { cfg.LabelTemplates = map[string]string{"1route": "{{.Method}}"} },
+		"header collision": func(cfg *Config) { cfg.LabelTemplates = map[string]string{"x_user_id": "{{.Method}}"} },
+		"fallback collision": func(cfg *Config) {
+			cfg.Metrics = []MetricDefinition{
+				{Name: "requests_other", Type: MetricTypeCounter, Headers: []string{"X-User-ID"}},
+				{Name: "requests_{{.Method}}", Type: MetricTypeCounter, Headers: []string{"X-User-ID"}},
+			}
+		},
+	}
+
+	for name, configure := range tests {
+		cfg := CreateConfig()
+		cfg.MetricHeaders = []string{"X-User-ID"}
+		cfg.DisableServer = true
+		configure(cfg)
+
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "invalid-template-test"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package custommetrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// labelTransform rewrites a header value before it becomes a label value.
+type labelTransform func(string) string
+
+// parseLabelTransform parses a transform name: "lower", "upper", "trim", or "sha256", optionally
+// followed by the number of hex characters of the digest to keep, e.g. "sha256:12".
+func parseLabelTransform(name string) (labelTransform, error) {
+	switch name {
+	case "lower":
+		return strings.ToLower, nil
+	case "upper":
+		return strings.ToUpper, nil
+	case "trim":
+		return strings.TrimSpace, nil
+	}
+
+	hashName, length, hasLength := strings.Cut(name, ":")
+	if hashName != "sha256" {
+		return nil, fmt.Errorf("unknown label transform %q, must be one of lower, upper, trim or sha256[:length]", name)
+	}
+	size := hex.EncodedLen(sha256.Size)
+	if hasLength {
+		var err error
+		size, err = strconv.Atoi(length)
+		if err != nil || size < 1 || size > hex.EncodedLen(sha256.Size) {
+			return nil, fmt.Errorf("label transform %q must keep between 1 and %d hex characters", name, hex.EncodedLen(sha256.Size))
+		}
+	}
+
+	return func(value string) string {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])[:size]
+	}, nil
+}
+
+// parseLabelTransforms parses a pipeline of transforms applied in order.
+func parseLabelTransforms(names []string) ([]labelTransform, error) {
+	transforms := make([]labelTransform, 0, len(names))
+	for _, name := range names {
+		transform, err := parseLabelTransform(name)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// transformLabelValue applies the transforms of a header to its value in order.
+func (c *CustomMetrics) transformLabelValue(headerName, value string) string {
+	for _, transform := range c.labelTransforms[headerName] {
+		value = transform(value)
+	}
+	return value
+}
@@ -0,0 +1,83 @@
+package custommetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabelTransforms(t *testing.T) {
+	tests := []struct {
+		transforms []string
+		value      string
+		expected   string
+	}{
+		{transforms: []string{"lower"}, value: "Acme Corp", expected: "acme corp"},
+		{transforms: []string{"upper"}, value: "eu-west", expected: "EU-WEST"},
+		{transforms: []string{"trim"}, value: "  acme\t", expected: "acme"},
+		{transforms: []string{"sha256"}, value: "user123", expected: "e606e38b0d8c19b24cf0ee3808183162ea7cd63ff7912dbb22b5e803286b4446"},
+		{transforms: []string{"sha256:12"}, value: "user123", expected: "e606e38b0d8c"},
+		{transforms: []string{"trim", "upper", "sha256:8"}, value: " alice ", expected: "e7dcee3c"},
+		{transforms: nil, value: "Unchanged", expected: "Unchanged"},
+	}
+
+	for _, test := range tests {
+		transforms, err := parseLabelTransforms(test.transforms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin := &CustomMetrics{labelTransforms: map[string][]labelTransform{"X-User-ID": transforms}}
+		if value := plugin.transformLabelValue("X-User-ID", test.value); value != test.expected {
+			t.Errorf("%v of %q: expected %q, got %q", test.transforms, test.value, test.expected, value)
+		}
+	}
+}
+
+func TestInvalidLabelTransforms(t *testing.T) {
+	for _, name := range []string{"title", "sha1", "sha256:", "sha256:0", "sha256:65", "sha256:abc"} {
+		if _, err := parseLabelTransform(name); err == nil {
+			t.Errorf("expected error for transform %q", name)
+		}
+	}
+}
+
+func TestLabelTransformsInCollection(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MetricHeaders = []string{"X-User-ID", "X-Tenant"}
+	cfg.MetricName = "transformed_requests"
+	cfg.DisableServer = true
+	cfg.LabelTransforms = map[string][]string{
+		"x-user-id": {"sha256:12"},
+		"X-Tenant":  {"trim", "lower"},
+	}
+	cfg.AllowedValues = map[string][]string{"X-Tenant": {"acme"}}
+
+	ctx := context.Background()
+	handler, err := New(ctx, http.NotFoundHandler(), cfg, "label-transforms-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transformed tenant is compared with the allowed values
+	for _, tenant := range []string{"ACME", " acme "} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-User-ID", "user123")
+		req.Header.Set("X-Tenant", tenant)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := `transformed_requests_total{x_tenant="acme",x_user_id="e606e38b0d8c"} 2`
+	if output := handler.(*CustomMetrics).renderPrometheusFormat(); !strings.Contains(output, expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+	}
+
+	cfg.LabelTransforms = map[string][]string{"X-User-ID": {"reverse"}}
+	if _, err := New(ctx, http.NotFoundHandler(), cfg, "invalid-label-transforms-test"); err == nil {
+		t.Error("expected error for an unknown transform")
+	}
+}